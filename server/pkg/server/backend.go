@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+var ErrNotFound = errors.New("key not found")
+var ErrReadOnly = errors.New("write in read-only transaction")
+
+// Backend is the ordered key value store that a Store keeps its records in.
+// Every backend has to give the same guarantees: Update runs fn in a single
+// atomic transaction which is discarded when fn returns an error, and
+// iteration visits keys in byte order.
+type Backend interface {
+	View(fn func(txn Txn) error) error
+	Update(fn func(txn Txn) error) error
+	Close() error
+}
+
+type Txn interface {
+	// Get returns ErrNotFound when the key does not exist.
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn for every key starting with prefix, in ascending
+	// key order or descending when reverse is set. Keys and values passed
+	// to fn may be retained. The transaction must not be written to from
+	// inside fn.
+	Iterate(prefix []byte, reverse bool, fn func(key []byte, value []byte) error) error
+	// IterateAfter is like Iterate but starts at the first key after
+	// start in iteration order, leaving out start itself. A nil start
+	// iterates over the whole prefix.
+	IterateAfter(prefix []byte, start []byte, reverse bool, fn func(key []byte, value []byte) error) error
+	// IterateKeys is like Iterate but does not read values.
+	IterateKeys(prefix []byte, fn func(key []byte) error) error
+}
+
+// Sizes of the batches of batchUpdate. Deleting is cheap, rewriting a value
+// means holding it in the transaction.
+const (
+	deleteBatchSize  = 1000
+	rewriteBatchSize = 100
+)
+
+// batchUpdate calls fn for every key, in as many transactions of at most
+// size keys as it takes: a single transaction can only be so big. The
+// batches before a failed one stay written.
+func batchUpdate(db Backend, keys [][]byte, size int, fn func(txn Txn, key []byte) error) error {
+	for len(keys) > 0 {
+		n := size
+		if n > len(keys) {
+			n = len(keys)
+		}
+		err := db.Update(func(txn Txn) error {
+			for _, key := range keys[:n] {
+				if err := fn(txn, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func deleteKey(txn Txn, key []byte) error {
+	return txn.Delete(key)
+}
+
+// OpenBackend opens the backend described by location. Locations look like
+// "badger://store.db", "sqlite://store.sqlite" or "memory://". A location
+// without a scheme is a badger directory, as it always has been.
+func OpenBackend(location string) (Backend, error) {
+	scheme, path := "badger", location
+	if i := strings.Index(location, "://"); i >= 0 {
+		scheme, path = location[:i], location[i+3:]
+	}
+
+	switch scheme {
+	case "badger":
+		return OpenBadgerBackend(path)
+	case "sqlite":
+		return OpenSQLiteBackend(path)
+	case "memory":
+		if path != "" {
+			log.Printf("ignoring path %s for in-memory store", path)
+		}
+		return NewMemoryBackend(), nil
+	default:
+		return nil, errors.New("unknown storage backend " + scheme)
+	}
+}
+
+// prefixEnd returns the smallest key that is larger than every key starting
+// with prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// unwrapBackend returns the backend underneath wrappers like
+// EncryptedBackend.
+func unwrapBackend(b Backend) Backend {
+	for {
+		w, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			return b
+		}
+		b = w.Unwrap()
+	}
+}
+
+// errStopIteration can be returned from an iteration callback to end the
+// iteration early. Backends pass it on like any error, callers check for it.
+var errStopIteration = errors.New("stop iteration")
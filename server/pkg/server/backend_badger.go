@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"github.com/dgraph-io/badger"
+	"os"
+	"path/filepath"
+)
+
+type BadgerBackend struct {
+	db  *badger.DB
+	dir string
+}
+
+func OpenBadgerBackend(location string) (*BadgerBackend, error) {
+	db, err := badger.Open(badger.DefaultOptions(location))
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerBackend{
+		db,
+		location,
+	}, nil
+}
+
+// gcDiscardRatio is the fraction of a value log file that has to be garbage
+// before it is rewritten.
+const gcDiscardRatio = 0.5
+
+// CollectGarbage compacts the LSM tree into a single level and then rewrites
+// value log files until none of them is worth rewriting anymore.
+func (b *BadgerBackend) CollectGarbage() error {
+	// compaction records which values are garbage, which GC relies on
+	if err := b.db.Flatten(2); err != nil {
+		return err
+	}
+
+	for {
+		err := b.db.RunValueLogGC(gcDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DiskSize adds up the size of the tables and value logs. badger's own Size
+// is only updated once a minute, too late to see what GC reclaimed.
+func (b *BadgerBackend) DiskSize() (int64, error) {
+	var res int64
+	for _, pattern := range []string{"*.sst", "*.vlog"} {
+		files, err := filepath.Glob(filepath.Join(b.dir, pattern))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			res += info.Size()
+		}
+	}
+	return res, nil
+}
+
+func (b *BadgerBackend) View(fn func(txn Txn) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (b *BadgerBackend) Update(fn func(txn Txn) error) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (b *BadgerBackend) Close() error {
+	return b.db.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key []byte, value []byte) error {
+	err := t.txn.Set(key, value)
+	if err == badger.ErrReadOnlyTxn {
+		return ErrReadOnly
+	}
+	return err
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	err := t.txn.Delete(key)
+	if err == badger.ErrReadOnlyTxn {
+		return ErrReadOnly
+	}
+	return err
+}
+
+func (t badgerTxn) Iterate(prefix []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.IterateAfter(prefix, nil, reverse, fn)
+}
+
+func (t badgerTxn) IterateAfter(prefix []byte, start []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.Reverse = reverse
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	seek := prefix
+	if start != nil {
+		seek = start
+	} else if reverse {
+		// reverse iteration seeks to the largest key <= the seek key
+		seek = append(append([]byte{}, prefix...), 0xff)
+	}
+
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		if start != nil && bytes.Equal(it.Item().Key(), start) {
+			continue
+		}
+
+		value, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(it.Item().KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t badgerTxn) IterateKeys(prefix []byte, fn func(key []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if err := fn(it.Item().KeyCopy(nil)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
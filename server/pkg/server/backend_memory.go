@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryBackend keeps everything in a map. It is meant for tests and small
+// deployments which do not care about losing their data on restart.
+type MemoryBackend struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		data: map[string][]byte{},
+	}
+}
+
+func (b *MemoryBackend) View(fn func(txn Txn) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return fn(&memoryTxn{b: b})
+}
+
+func (b *MemoryBackend) Update(fn func(txn Txn) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	txn := &memoryTxn{
+		b:       b,
+		pending: map[string][]byte{},
+	}
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	for key, value := range txn.pending {
+		if value == nil {
+			delete(b.data, key)
+		} else {
+			b.data[key] = value
+		}
+	}
+
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+type memoryTxn struct {
+	b *MemoryBackend
+	// writes of this transaction, a nil value is a delete.
+	// nil for read-only transactions.
+	pending map[string][]byte
+}
+
+func (t *memoryTxn) get(key string) ([]byte, bool) {
+	if value, ok := t.pending[key]; ok {
+		return value, value != nil
+	}
+	value, ok := t.b.data[key]
+	return value, ok
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	value, ok := t.get(string(key))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (t *memoryTxn) Set(key []byte, value []byte) error {
+	if t.pending == nil {
+		return ErrReadOnly
+	}
+	t.pending[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.pending == nil {
+		return ErrReadOnly
+	}
+	t.pending[string(key)] = nil
+	return nil
+}
+
+func (t *memoryTxn) keys(prefix []byte) []string {
+	p := string(prefix)
+	seen := map[string]bool{}
+	var res []string
+	add := func(key string) {
+		if strings.HasPrefix(key, p) && !seen[key] {
+			seen[key] = true
+			res = append(res, key)
+		}
+	}
+
+	for key := range t.b.data {
+		add(key)
+	}
+	for key := range t.pending {
+		add(key)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.IterateAfter(prefix, nil, reverse, fn)
+}
+
+func (t *memoryTxn) IterateAfter(prefix []byte, start []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	keys := t.keys(prefix)
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	for _, key := range keys {
+		if start != nil && (reverse && key >= string(start) || !reverse && key <= string(start)) {
+			continue
+		}
+
+		value, ok := t.get(key)
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(key), append([]byte{}, value...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTxn) IterateKeys(prefix []byte, fn func(key []byte) error) error {
+	for _, key := range t.keys(prefix) {
+		if _, ok := t.get(key); !ok {
+			continue
+		}
+		if err := fn([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// number of rows fetched per query while iterating
+const sqliteBatchSize = 256
+
+// SQLiteBackend stores all keys in a single table of a SQLite database.
+type SQLiteBackend struct {
+	db *sql.DB
+	// SQLite allows only one writer at a time. Serializing updates here
+	// avoids busy errors when two transactions try to upgrade their locks.
+	writeLock sync.Mutex
+}
+
+func OpenSQLiteBackend(location string) (*SQLiteBackend, error) {
+	db, err := sql.Open("sqlite", "file:"+location+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS kv (key BLOB PRIMARY KEY, value BLOB NOT NULL) WITHOUT ROWID")
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &SQLiteBackend{
+		db: db,
+	}, nil
+}
+
+func (b *SQLiteBackend) View(fn func(txn Txn) error) error {
+	tx, err := b.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(sqliteTxn{tx, true})
+}
+
+func (b *SQLiteBackend) Update(fn func(txn Txn) error) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(sqliteTxn{tx, false}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *SQLiteBackend) Close() error {
+	return b.db.Close()
+}
+
+type sqliteTxn struct {
+	tx       *sql.Tx
+	readOnly bool
+}
+
+func (t sqliteTxn) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := t.tx.QueryRow("SELECT value FROM kv WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (t sqliteTxn) Set(key []byte, value []byte) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := t.tx.Exec("INSERT INTO kv (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+func (t sqliteTxn) Delete(key []byte) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	_, err := t.tx.Exec("DELETE FROM kv WHERE key = ?", key)
+	return err
+}
+
+// batch fetches at most sqliteBatchSize rows between from and to in key
+// order, excluding from itself when after is set. from is the lower bound,
+// or the upper bound when iterating in reverse. A nil bound is unbounded.
+func (t sqliteTxn) batch(from []byte, after bool, to []byte, reverse bool, values bool) ([][2][]byte, error) {
+	columns := "key, NULL"
+	if values {
+		columns = "key, value"
+	}
+
+	lower, upper, order := ">=", "<", "ASC"
+	if reverse {
+		lower, upper, order = "<", ">=", "DESC"
+	} else if after {
+		lower = ">"
+	}
+
+	query := "SELECT " + columns + " FROM kv WHERE 1"
+	var args []interface{}
+	if from != nil {
+		query += " AND key " + lower + " ?"
+		args = append(args, from)
+	}
+	if to != nil {
+		query += " AND key " + upper + " ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY key " + order + " LIMIT ?"
+	args = append(args, sqliteBatchSize)
+
+	rows, err := t.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res [][2][]byte
+	for rows.Next() {
+		var row [2][]byte
+		if err := rows.Scan(&row[0], &row[1]); err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+
+	return res, rows.Err()
+}
+
+// iterate pages through the keys with prefix, after start when it is set.
+// Rows are fetched in batches so fn can query the same transaction while
+// iterating.
+func (t sqliteTxn) iterate(prefix []byte, start []byte, reverse bool, values bool, fn func(key []byte, value []byte) error) error {
+	from, to := prefix, prefixEnd(prefix)
+	if reverse {
+		from, to = to, prefix
+	}
+	after := false
+	if start != nil {
+		from, after = start, true
+	}
+
+	for {
+		rows, err := t.batch(from, after, to, reverse, values)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if err := fn(row[0], row[1]); err != nil {
+				return err
+			}
+		}
+
+		if len(rows) < sqliteBatchSize {
+			return nil
+		}
+		from, after = rows[len(rows)-1][0], true
+	}
+}
+
+func (t sqliteTxn) Iterate(prefix []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.iterate(prefix, nil, reverse, true, fn)
+}
+
+func (t sqliteTxn) IterateAfter(prefix []byte, start []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.iterate(prefix, start, reverse, true, fn)
+}
+
+func (t sqliteTxn) IterateKeys(prefix []byte, fn func(key []byte) error) error {
+	return t.iterate(prefix, nil, false, false, func(key []byte, _ []byte) error {
+		return fn(key)
+	})
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// backends opens every Backend implementation, so each test below checks
+// that they all give the same guarantees.
+var backends = []struct {
+	name string
+	open func(t *testing.T) Backend
+}{
+	{"badger", func(t *testing.T) Backend {
+		b, err := OpenBadgerBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}},
+	{"sqlite", func(t *testing.T) Backend {
+		b, err := OpenSQLiteBackend(filepath.Join(t.TempDir(), "store.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}},
+	{"memory", func(t *testing.T) Backend {
+		return NewMemoryBackend()
+	}},
+}
+
+var errRollback = errors.New("rollback")
+
+func set(t *testing.T, b Backend, pairs ...string) {
+	t.Helper()
+	err := b.Update(func(txn Txn) error {
+		for i := 0; i < len(pairs); i += 2 {
+			if err := txn.Set([]byte(pairs[i]), []byte(pairs[i+1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, b Backend, key string) (string, error) {
+	t.Helper()
+	var res []byte
+	err := b.View(func(txn Txn) error {
+		var err error
+		res, err = txn.Get([]byte(key))
+		return err
+	})
+	return string(res), err
+}
+
+func keys(t *testing.T, b Backend, prefix string, start string, reverse bool) []string {
+	t.Helper()
+	var startKey []byte
+	if start != "" {
+		startKey = []byte(start)
+	}
+
+	res := []string{}
+	err := b.View(func(txn Txn) error {
+		return txn.IterateAfter([]byte(prefix), startKey, reverse, func(key []byte, value []byte) error {
+			res = append(res, string(key)+"="+string(value))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, b Backend)
+	}{
+		{"get set delete", func(t *testing.T, b Backend) {
+			if _, err := get(t, b, "a"); err != ErrNotFound {
+				t.Fatalf("get of a missing key: %v, want ErrNotFound", err)
+			}
+
+			set(t, b, "a", "1")
+			if v, err := get(t, b, "a"); err != nil || v != "1" {
+				t.Fatalf("get: %q, %v", v, err)
+			}
+
+			set(t, b, "a", "2")
+			if v, err := get(t, b, "a"); err != nil || v != "2" {
+				t.Fatalf("get after overwrite: %q, %v", v, err)
+			}
+
+			err := b.Update(func(txn Txn) error {
+				return txn.Delete([]byte("a"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := get(t, b, "a"); err != ErrNotFound {
+				t.Fatalf("get after delete: %v, want ErrNotFound", err)
+			}
+
+			// deleting what isn't there is fine
+			err = b.Update(func(txn Txn) error {
+				return txn.Delete([]byte("a"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"empty value", func(t *testing.T, b Backend) {
+			set(t, b, "a", "")
+			if v, err := get(t, b, "a"); err != nil || v != "" {
+				t.Fatalf("get: %q, %v", v, err)
+			}
+		}},
+		{"iteration order", func(t *testing.T, b Backend) {
+			set(t, b, "p_b", "2", "p_a", "1", "p_c", "3", "p", "0", "q_a", "4", "o_z", "5", "p_\xff", "6")
+
+			want := []string{"p_a=1", "p_b=2", "p_c=3", "p_\xff=6"}
+			if got := keys(t, b, "p_", "", false); !reflect.DeepEqual(got, want) {
+				t.Errorf("forward: %q, want %q", got, want)
+			}
+
+			want = []string{"p_\xff=6", "p_c=3", "p_b=2", "p_a=1"}
+			if got := keys(t, b, "p_", "", true); !reflect.DeepEqual(got, want) {
+				t.Errorf("reverse: %q, want %q", got, want)
+			}
+
+			want = []string{"p_c=3", "p_\xff=6"}
+			if got := keys(t, b, "p_", "p_b", false); !reflect.DeepEqual(got, want) {
+				t.Errorf("forward after p_b: %q, want %q", got, want)
+			}
+
+			want = []string{"p_a=1"}
+			if got := keys(t, b, "p_", "p_b", true); !reflect.DeepEqual(got, want) {
+				t.Errorf("reverse after p_b: %q, want %q", got, want)
+			}
+
+			want = []string{"p=0", "p_a=1", "p_b=2", "p_c=3", "p_\xff=6"}
+			if got := keys(t, b, "p", "", false); !reflect.DeepEqual(got, want) {
+				t.Errorf("shorter prefix: %q, want %q", got, want)
+			}
+
+			if got := keys(t, b, "x", "", false); len(got) != 0 {
+				t.Errorf("missing prefix: %q, want nothing", got)
+			}
+		}},
+		{"iterate keys", func(t *testing.T, b Backend) {
+			set(t, b, "k_2", "b", "k_1", "a", "l_1", "c")
+
+			var got []string
+			err := b.View(func(txn Txn) error {
+				return txn.IterateKeys([]byte("k_"), func(key []byte) error {
+					got = append(got, string(key))
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"k_1", "k_2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("keys: %q, want %q", got, want)
+			}
+		}},
+		{"iteration stops on error", func(t *testing.T, b Backend) {
+			set(t, b, "s_1", "", "s_2", "", "s_3", "")
+
+			n := 0
+			err := b.View(func(txn Txn) error {
+				return txn.Iterate([]byte("s_"), false, func(key []byte, value []byte) error {
+					n += 1
+					return errStopIteration
+				})
+			})
+			if err != errStopIteration || n != 1 {
+				t.Errorf("got %v after %d keys, want errStopIteration after 1", err, n)
+			}
+		}},
+		{"update rolls back on error", func(t *testing.T, b Backend) {
+			set(t, b, "a", "1", "b", "2")
+
+			err := b.Update(func(txn Txn) error {
+				if err := txn.Set([]byte("a"), []byte("changed")); err != nil {
+					return err
+				}
+				if err := txn.Set([]byte("c"), []byte("new")); err != nil {
+					return err
+				}
+				if err := txn.Delete([]byte("b")); err != nil {
+					return err
+				}
+				return errRollback
+			})
+			if err != errRollback {
+				t.Fatalf("update returned %v, want its own error", err)
+			}
+
+			want := []string{"a=1", "b=2"}
+			if got := keys(t, b, "", "", false); !reflect.DeepEqual(got, want) {
+				t.Errorf("after rollback: %q, want %q", got, want)
+			}
+		}},
+		{"update sees its own writes", func(t *testing.T, b Backend) {
+			set(t, b, "w_a", "1", "w_b", "2")
+
+			err := b.Update(func(txn Txn) error {
+				if err := txn.Set([]byte("w_c"), []byte("3")); err != nil {
+					return err
+				}
+				if err := txn.Delete([]byte("w_a")); err != nil {
+					return err
+				}
+
+				if v, err := txn.Get([]byte("w_c")); err != nil || string(v) != "3" {
+					t.Errorf("get of a pending write: %q, %v", v, err)
+				}
+				if _, err := txn.Get([]byte("w_a")); err != ErrNotFound {
+					t.Errorf("get of a pending delete: %v, want ErrNotFound", err)
+				}
+
+				var got []string
+				err := txn.Iterate([]byte("w_"), false, func(key []byte, value []byte) error {
+					got = append(got, string(key)+"="+string(value))
+					return nil
+				})
+				if want := []string{"w_b=2", "w_c=3"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("iteration in the transaction: %q, want %q", got, want)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{"w_b=2", "w_c=3"}
+			if got := keys(t, b, "w_", "", false); !reflect.DeepEqual(got, want) {
+				t.Errorf("after commit: %q, want %q", got, want)
+			}
+		}},
+		{"view is read only", func(t *testing.T, b Backend) {
+			set(t, b, "a", "1")
+
+			err := b.View(func(txn Txn) error {
+				if err := txn.Set([]byte("a"), []byte("2")); err != ErrReadOnly {
+					t.Errorf("set in a view: %v, want ErrReadOnly", err)
+				}
+				if err := txn.Delete([]byte("a")); err != ErrReadOnly {
+					t.Errorf("delete in a view: %v, want ErrReadOnly", err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v, err := get(t, b, "a"); err != nil || v != "1" {
+				t.Fatalf("get after a view: %q, %v", v, err)
+			}
+		}},
+		{"view returns its error", func(t *testing.T, b Backend) {
+			err := b.View(func(txn Txn) error {
+				return errRollback
+			})
+			if err != errRollback {
+				t.Errorf("view returned %v, want its own error", err)
+			}
+		}},
+		{"values are copies", func(t *testing.T, b Backend) {
+			value := []byte("abc")
+			err := b.Update(func(txn Txn) error {
+				return txn.Set([]byte("a"), value)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			value[0] = 'x'
+
+			var kept [][]byte
+			err = b.View(func(txn Txn) error {
+				return txn.Iterate([]byte("a"), false, func(key []byte, value []byte) error {
+					kept = append(kept, value)
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kept) != 1 || string(kept[0]) != "abc" {
+				t.Errorf("iterated %q, want the value as it was set", kept)
+			}
+		}},
+	}
+
+	for _, backend := range backends {
+		for _, test := range tests {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				b := backend.open(t)
+				defer b.Close()
+				test.run(t, b)
+			})
+		}
+	}
+}
+
+func TestBatchUpdate(t *testing.T) {
+	b := NewMemoryBackend()
+	var all [][]byte
+	for i := 0; i < 25; i++ {
+		all = append(all, []byte(fmt.Sprintf("k_%02d", i)))
+	}
+
+	batches := 0
+	err := batchUpdate(b, all, 10, func(txn Txn, key []byte) error {
+		if string(key) == "k_10" || string(key) == "k_20" || string(key) == "k_00" {
+			batches += 1
+		}
+		return txn.Set(key, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(t, b, "k_", "", false); len(got) != 25 || batches != 3 {
+		t.Errorf("wrote %d keys in %d batches, want 25 in 3", len(got), batches)
+	}
+
+	// a failing batch is rolled back, those before it stay
+	err = batchUpdate(b, all, 10, func(txn Txn, key []byte) error {
+		if string(key) == "k_15" {
+			return errRollback
+		}
+		return txn.Delete(key)
+	})
+	if err != errRollback {
+		t.Fatalf("got %v, want the error of fn", err)
+	}
+	if got := keys(t, b, "k_", "", false); len(got) != 15 || got[0] != "k_10=k_10" {
+		t.Errorf("left %q, want k_10 to k_24", got)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/pb"
+	"github.com/google/uuid"
+	"io"
+	"os"
+)
+
+var ErrBackupUnsupported = errors.New("backups are only supported for the badger backend")
+
+// badger's meta bit for deleted keys, see badger/value.go
+const badgerBitDelete = 1 << 0
+
+// Backup writes a badger backup stream of everything that changed since
+// the given version to w, while the store stays online. It returns the
+// version to pass as since for the next incremental backup.
+func (s Store) Backup(w io.Writer, since uint64) (uint64, error) {
+	b, ok := unwrapBackend(s.db).(*BadgerBackend)
+	if !ok {
+		return 0, ErrBackupUnsupported
+	}
+	return b.db.Backup(w, since)
+}
+
+// BackupStats is what a sequence of backups contains once loaded,
+// and what a restore is checked against.
+type BackupStats struct {
+	Users int
+	Tabs  int
+	Keys  int
+}
+
+func (b BackupStats) String() string {
+	return fmt.Sprintf("%d users, %d tabs, %d keys", b.Users, b.Tabs, b.Keys)
+}
+
+// ReadBackupStats counts the keys which exist after loading backups in order,
+// without loading them anywhere.
+func ReadBackupStats(backups ...io.Reader) (BackupStats, error) {
+	type latest struct {
+		version uint64
+		deleted bool
+	}
+	keys := map[string]latest{}
+
+	for _, backup := range backups {
+		r := bufio.NewReader(backup)
+		for {
+			var size uint64
+			err := binary.Read(r, binary.LittleEndian, &size)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return BackupStats{}, err
+			}
+
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return BackupStats{}, err
+			}
+
+			var list pb.KVList
+			if err := list.Unmarshal(buf); err != nil {
+				return BackupStats{}, err
+			}
+
+			for _, kv := range list.Kv {
+				old, ok := keys[string(kv.Key)]
+				if ok && old.version > kv.Version {
+					continue
+				}
+				keys[string(kv.Key)] = latest{
+					version: kv.Version,
+					deleted: len(kv.Meta) > 0 && kv.Meta[0]&badgerBitDelete != 0,
+				}
+			}
+		}
+	}
+
+	var res BackupStats
+	for key, l := range keys {
+		if l.deleted {
+			continue
+		}
+		res.Keys += 1
+		if bytes.HasPrefix([]byte(key), []byte(userPrefix)) {
+			res.Users += 1
+		} else if bytes.HasPrefix([]byte(key), []byte(tabPrefix)) {
+			res.Tabs += 1
+		}
+	}
+
+	return res, nil
+}
+
+// RestoreBackup loads backup files, a full backup followed by any incremental
+// ones, into a new badger directory. The restored store is then checked
+// against the contents of the backups before the stats are returned. Backups
+// of an encrypted store need the same encryption key to be checked.
+func RestoreBackup(location string, files ...string) (BackupStats, error) {
+	if entries, err := os.ReadDir(location); err == nil && len(entries) > 0 {
+		return BackupStats{}, fmt.Errorf("%s is not empty, restore into a fresh directory", location)
+	}
+
+	var backups []*os.File
+	var readers []io.Reader
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return BackupStats{}, err
+		}
+		defer f.Close()
+		backups = append(backups, f)
+		readers = append(readers, f)
+	}
+
+	expected, err := ReadBackupStats(readers...)
+	if err != nil {
+		return BackupStats{}, err
+	}
+
+	backend, err := OpenBadgerBackend(location)
+	if err != nil {
+		return BackupStats{}, err
+	}
+
+	for _, f := range backups {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			_ = backend.Close()
+			return BackupStats{}, err
+		}
+		if err := backend.db.Load(f, 256); err != nil {
+			_ = backend.Close()
+			return BackupStats{}, err
+		}
+	}
+
+	// the data key is only there after loading
+	db, err := withEncryption(backend)
+	if err != nil {
+		return BackupStats{}, err
+	}
+	store := NewStoreWithBackend(db)
+	defer store.Close()
+
+	restored, err := store.verifyRestore()
+	if err != nil {
+		return restored, err
+	}
+	if restored != expected {
+		return restored, fmt.Errorf("restored %s, but the backup contains %s", restored, expected)
+	}
+
+	return restored, nil
+}
+
+// verifyRestore counts what is in the store, checking that every
+// user and tab decodes and is stored under the key it should be.
+func (s Store) verifyRestore() (BackupStats, error) {
+	var res BackupStats
+	err := s.db.View(func(txn Txn) error {
+		err := txn.IterateKeys(nil, func(_ []byte) error {
+			res.Keys += 1
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Iterate([]byte(userPrefix), false, func(key []byte, val []byte) error {
+			var user User
+			if err := decodeJSON(key, val, &user); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if !bytes.Equal(key, prefix(userPrefix, user.Name)) {
+				return fmt.Errorf("%s holds user %s", key, user.Name)
+			}
+			res.Users += 1
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return txn.Iterate([]byte(tabPrefix), false, func(key []byte, val []byte) error {
+			var tab Tab
+			if err := decodeJSON(key, val, &tab); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if tab.Id == uuid.Nil || !bytes.Equal(key, prefix(tabPrefix, tab.Id.String())) {
+				return fmt.Errorf("%s holds tab %s", key, tab.Id)
+			}
+			res.Tabs += 1
+			return nil
+		})
+	})
+	return res, err
+}
@@ -0,0 +1,597 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Collections group the tabs of a user. They nest through Parent, and a tab
+// can be in several of them, so membership is stored on the tab itself in
+// Tab.Collections and indexed like everything else about a tab.
+const collectionPrefix = "coll_"
+
+// idx_coll_<collection>\x00<tab> lists the tabs in a collection by id. The
+// collections of a user and those shared with a user are indexed as
+// idx_collown_<owner>\x00<collection> and idx_collshared_<user>\x00<collection>.
+const collectionIndexPrefix = indexPrefix + "coll_"
+const collectionOwnerIndexPrefix = indexPrefix + "collown_"
+const collectionSharedIndexPrefix = indexPrefix + "collshared_"
+
+var ErrCollectionNotFound = errors.New("collection not found")
+var ErrEmptyName = errors.New("name cannot be empty")
+var ErrInvalidParent = errors.New("parent is not a collection of this user, or lies inside the collection")
+var ErrNotOwnTab = errors.New("tab does not belong to the owner of the collection")
+
+type Collection struct {
+	Id       uuid.UUID
+	Owner    string
+	Name     string
+	Parent   *uuid.UUID `json:",omitempty"` // nil for top level collections
+	Position int        // Order among the collections with the same parent
+	// Shared collections can be seen by the users in SharedWith, public ones
+	// by everyone. Besides the owner, admins and the users in SharedWith,
+	// everyone only sees the public tabs in them.
+	Public     bool
+	SharedWith []string `json:",omitempty"`
+	CreatedAt  time.Time
+}
+
+// VisibleTo tells whether a user, or nobody when user is nil, may look at
+// the collection.
+func (c *Collection) VisibleTo(user *User) bool {
+	return c.Public || c.ShowsAllTabsTo(user)
+}
+
+// ShowsAllTabsTo tells whether a user sees all tabs in the collection, not
+// only the public ones: the owner, admins and the users it is shared with.
+func (c *Collection) ShowsAllTabsTo(user *User) bool {
+	if user == nil {
+		return false
+	}
+	if user.Name == c.Owner || user.Admin {
+		return true
+	}
+	for _, name := range c.SharedWith {
+		if name == user.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func collectionKey(id uuid.UUID) []byte {
+	return prefix(collectionPrefix, id.String())
+}
+
+func collectionScope(id uuid.UUID) string {
+	return "coll_" + id.String()
+}
+
+// the public tabs of a collection, for those who don't see all of them
+func collectionPublicScope(id uuid.UUID) string {
+	return "collpub_" + id.String()
+}
+
+func collectionIndexPrefixFor(id uuid.UUID) []byte {
+	return prefix(collectionIndexPrefix, id.String()+"\x00")
+}
+
+func collectionOwnerIndexPrefixFor(owner string) []byte {
+	return prefix(collectionOwnerIndexPrefix, owner+"\x00")
+}
+
+func collectionSharedIndexPrefixFor(name string) []byte {
+	return prefix(collectionSharedIndexPrefix, name+"\x00")
+}
+
+// collectionTabIndexKeys are the keys listing a tab in its collections.
+func collectionTabIndexKeys(tab *Tab, updated time.Time) [][]byte {
+	var keys [][]byte
+	for _, id := range tab.Collections {
+		keys = append(keys, append(collectionIndexPrefixFor(id), tab.Id.String()...))
+		keys = append(keys, sortIndexKeys(collectionScope(id), tab, updated)...)
+		if tab.Public {
+			keys = append(keys, sortIndexKeys(collectionPublicScope(id), tab, updated)...)
+		}
+	}
+	return keys
+}
+
+func collectionIndexKeys(c *Collection) [][]byte {
+	keys := [][]byte{
+		append(collectionOwnerIndexPrefixFor(c.Owner), c.Id.String()...),
+	}
+	for _, name := range c.SharedWith {
+		keys = append(keys, append(collectionSharedIndexPrefixFor(name), c.Id.String()...))
+	}
+	return keys
+}
+
+func putCollection(txn Txn, c *Collection) error {
+	err := setJSON(txn, collectionKey(c.Id), c)
+	if err != nil {
+		return err
+	}
+	return setIndexes(txn, c.Id, collectionIndexKeys(c))
+}
+
+func getCollection(txn Txn, id uuid.UUID) (*Collection, error) {
+	var res Collection
+	err := getJSON(txn, collectionKey(id), &res)
+	if err == ErrNotFound {
+		return nil, ErrCollectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// indexedCollections looks up the collections an index points to.
+func indexedCollections(txn Txn, p []byte) ([]Collection, error) {
+	var ids []uuid.UUID
+	err := txn.IterateKeys(p, func(key []byte) error {
+		id, err := indexedTabId(key)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Collection{}
+	for _, id := range ids {
+		c, err := getCollection(txn, id)
+		if err == ErrCollectionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *c)
+	}
+	return res, nil
+}
+
+// siblings returns the collections of owner with the given parent, in order.
+func siblings(txn Txn, owner string, parent *uuid.UUID) ([]Collection, error) {
+	all, err := indexedCollections(txn, collectionOwnerIndexPrefixFor(owner))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Collection
+	for _, c := range all {
+		if sameParent(c.Parent, parent) {
+			res = append(res, c)
+		}
+	}
+	sortCollections(res)
+	return res, nil
+}
+
+func sameParent(a *uuid.UUID, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sortCollections orders collections by parent, then position.
+func sortCollections(collections []Collection) {
+	parent := func(c *Collection) string {
+		if c.Parent == nil {
+			return ""
+		}
+		return c.Parent.String()
+	}
+
+	sort.SliceStable(collections, func(i, j int) bool {
+		a, b := &collections[i], &collections[j]
+		if parent(a) != parent(b) {
+			return parent(a) < parent(b)
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.Name < b.Name
+	})
+}
+
+// checkParent makes sure parent can hold the collection id of owner, which
+// it can't when parent is id itself or one of its descendants.
+func checkParent(txn Txn, owner string, id uuid.UUID, parent *uuid.UUID) error {
+	for p := parent; p != nil; {
+		if *p == id {
+			return ErrInvalidParent
+		}
+
+		c, err := getCollection(txn, *p)
+		if err == ErrCollectionNotFound {
+			return ErrInvalidParent
+		}
+		if err != nil {
+			return err
+		}
+		if c.Owner != owner {
+			return ErrInvalidParent
+		}
+		p = c.Parent
+	}
+	return nil
+}
+
+// CreateCollection adds a collection to the end of its parent.
+func (s Store) CreateCollection(owner string, name string, parent *uuid.UUID) (*Collection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrEmptyName
+	}
+
+	res := &Collection{
+		Id:        uuid.New(),
+		Owner:     owner,
+		Name:      name,
+		Parent:    parent,
+		CreatedAt: time.Now(),
+	}
+	err := s.db.Update(func(txn Txn) error {
+		err := checkParent(txn, owner, res.Id, parent)
+		if err != nil {
+			return err
+		}
+
+		others, err := siblings(txn, owner, parent)
+		if err != nil {
+			return err
+		}
+		if len(others) > 0 {
+			res.Position = others[len(others)-1].Position + 1
+		}
+
+		return putCollection(txn, res)
+	})
+	return res, err
+}
+
+// GetCollection returns a collection, or ErrCollectionNotFound.
+func (s Store) GetCollection(id uuid.UUID) (*Collection, error) {
+	var res *Collection
+	err := s.db.View(func(txn Txn) error {
+		var err error
+		res, err = getCollection(txn, id)
+		return err
+	})
+	return res, err
+}
+
+// GetCollections lists the collections of a user and those shared with them,
+// ordered by parent and position.
+func (s Store) GetCollections(name string) (own []Collection, shared []Collection, err error) {
+	err = s.db.View(func(txn Txn) error {
+		var err error
+		own, err = indexedCollections(txn, collectionOwnerIndexPrefixFor(name))
+		if err != nil {
+			return err
+		}
+		shared, err = indexedCollections(txn, collectionSharedIndexPrefixFor(name))
+		return err
+	})
+	sortCollections(own)
+	sortCollections(shared)
+	return own, shared, err
+}
+
+// updateCollection applies change to a stored collection.
+func (s Store) updateCollection(id uuid.UUID, change func(txn Txn, c *Collection) error) (*Collection, error) {
+	var res *Collection
+	err := s.db.Update(func(txn Txn) error {
+		c, err := getCollection(txn, id)
+		if err != nil {
+			return err
+		}
+		if err := change(txn, c); err != nil {
+			return err
+		}
+
+		res = c
+		return putCollection(txn, c)
+	})
+	return res, err
+}
+
+func (s Store) RenameCollection(id uuid.UUID, name string) (*Collection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrEmptyName
+	}
+
+	return s.updateCollection(id, func(_ Txn, c *Collection) error {
+		c.Name = name
+		return nil
+	})
+}
+
+// MoveCollection nests a collection in another one, or at the top level when
+// parent is nil. It goes to the end of its new parent.
+func (s Store) MoveCollection(id uuid.UUID, parent *uuid.UUID) (*Collection, error) {
+	return s.updateCollection(id, func(txn Txn, c *Collection) error {
+		if sameParent(c.Parent, parent) {
+			return nil
+		}
+
+		err := checkParent(txn, c.Owner, c.Id, parent)
+		if err != nil {
+			return err
+		}
+
+		others, err := siblings(txn, c.Owner, parent)
+		if err != nil {
+			return err
+		}
+		c.Parent = parent
+		c.Position = 0
+		if len(others) > 0 {
+			c.Position = others[len(others)-1].Position + 1
+		}
+		return nil
+	})
+}
+
+// ShareCollection decides who can see a collection besides its owner.
+func (s Store) ShareCollection(id uuid.UUID, public bool, with []string) (*Collection, error) {
+	return s.updateCollection(id, func(txn Txn, c *Collection) error {
+		seen := map[string]bool{}
+		var names []string
+		for _, name := range with {
+			if name == c.Owner || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			err := getJSON(txn, prefix(userPrefix, name), &User{})
+			if err == ErrNotFound {
+				return ErrUnknownRecipient
+			}
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+
+		c.Public = public
+		c.SharedWith = names
+		return nil
+	})
+}
+
+// ReorderCollections puts the collections of owner with the given parent in
+// the order of ids. Collections left out keep their order after those.
+func (s Store) ReorderCollections(owner string, parent *uuid.UUID, ids []uuid.UUID) error {
+	return s.db.Update(func(txn Txn) error {
+		others, err := siblings(txn, owner, parent)
+		if err != nil {
+			return err
+		}
+
+		byId := map[uuid.UUID]Collection{}
+		for _, c := range others {
+			byId[c.Id] = c
+		}
+
+		var ordered []Collection
+		placed := map[uuid.UUID]bool{}
+		for _, id := range ids {
+			c, ok := byId[id]
+			if !ok {
+				return ErrCollectionNotFound
+			}
+			if !placed[id] {
+				placed[id] = true
+				ordered = append(ordered, c)
+			}
+		}
+		for _, c := range others {
+			if !placed[c.Id] {
+				ordered = append(ordered, c)
+			}
+		}
+
+		for i := range ordered {
+			if ordered[i].Position == i {
+				continue
+			}
+			ordered[i].Position = i
+			if err := setJSON(txn, collectionKey(ordered[i].Id), &ordered[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteCollection removes a collection. Its tabs are kept and the
+// collections in it move up to its parent.
+func (s Store) DeleteCollection(id uuid.UUID) error {
+	return s.db.Update(func(txn Txn) error {
+		c, err := getCollection(txn, id)
+		if err != nil {
+			return err
+		}
+
+		children, err := siblings(txn, c.Owner, &c.Id)
+		if err != nil {
+			return err
+		}
+		others, err := siblings(txn, c.Owner, c.Parent)
+		if err != nil {
+			return err
+		}
+		position := 0
+		if len(others) > 0 {
+			position = others[len(others)-1].Position + 1
+		}
+		for i := range children {
+			children[i].Parent = c.Parent
+			children[i].Position = position + i
+			if err := setJSON(txn, collectionKey(children[i].Id), &children[i]); err != nil {
+				return err
+			}
+		}
+
+		var tabs []uuid.UUID
+		err = txn.IterateKeys(collectionIndexPrefixFor(id), func(key []byte) error {
+			tab, err := indexedTabId(key)
+			if err != nil {
+				return err
+			}
+			tabs = append(tabs, tab)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tab := range tabs {
+			err := changeTabCollections(txn, tab, c.Owner, &id, nil)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+
+		if err := rmTabIndexes(txn, id); err != nil {
+			return err
+		}
+		return txn.Delete(collectionKey(id))
+	})
+}
+
+// rmUserCollections deletes the collections of a deleted user. Their tabs
+// are in the trash, where collections don't matter.
+func rmUserCollections(txn Txn, owner string) error {
+	collections, err := indexedCollections(txn, collectionOwnerIndexPrefixFor(owner))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range collections {
+		if err := rmTabIndexes(txn, c.Id); err != nil {
+			return err
+		}
+		if err := txn.Delete(collectionKey(c.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeTabCollections takes a tab of owner out of collection from and puts
+// it in collection to. Either can be nil.
+func changeTabCollections(txn Txn, id uuid.UUID, owner string, from *uuid.UUID, to *uuid.UUID) error {
+	var tab Tab
+	err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+	if err != nil {
+		return err
+	}
+	if tab.Owner != owner {
+		return ErrNotOwnTab
+	}
+
+	var res []uuid.UUID
+	for _, c := range tab.Collections {
+		if (from == nil || c != *from) && (to == nil || c != *to) {
+			res = append(res, c)
+		}
+	}
+	if to != nil {
+		res = append(res, *to)
+	}
+	tab.Collections = res
+
+	return putTab(txn, &tab)
+}
+
+// MoveTabs moves tabs from one collection of owner to another. With from nil
+// the tabs are added to to, with to nil they are removed from from.
+func (s Store) MoveTabs(owner string, tabs []uuid.UUID, from *uuid.UUID, to *uuid.UUID) error {
+	return s.db.Update(func(txn Txn) error {
+		for _, id := range []*uuid.UUID{from, to} {
+			if id == nil {
+				continue
+			}
+			c, err := getCollection(txn, *id)
+			if err != nil {
+				return err
+			}
+			if c.Owner != owner {
+				return ErrCollectionNotFound
+			}
+		}
+
+		for _, id := range tabs {
+			err := changeTabCollections(txn, id, owner, from, to)
+			if err == ErrNotFound {
+				return ErrNotOwnTab
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetCollectionTabsPage lists the tabs in a collection. Without all, only
+// the public ones are listed. Without a sort order the tabs of the owner are
+// listed by id and the public ones the most recently updated first.
+func (s Store) GetCollectionTabsPage(id uuid.UUID, all bool, page Page) (TabPage, error) {
+	if all && page.Sort == "" {
+		return s.tabPage(collectionIndexPrefixFor(id), page)
+	}
+
+	scope := collectionScope(id)
+	if !all {
+		scope = collectionPublicScope(id)
+		if page.Sort == "" {
+			page.Sort, page.Desc = SortUpdated, true
+		}
+	}
+	if !validTabSort(page.Sort) {
+		return TabPage{}, ErrInvalidSort
+	}
+	return s.tabPage(sortIndexPrefixFor(scope, page.Sort), page)
+}
+
+// writeCollectionError answers a request which failed on a collection, and
+// reports whether err was such an error.
+func writeCollectionError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case ErrEmptyName, ErrInvalidParent, ErrNotOwnTab, ErrUnknownRecipient, ErrInvalidSort, ErrInvalidCursor:
+		w.WriteHeader(http.StatusBadRequest)
+	case ErrCollectionNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		return false
+	}
+
+	_, _ = w.Write([]byte(err.Error()))
+	return true
+}
+
+// parseOptionalId parses the id of a collection, where "" means none.
+func parseOptionalId(s string) (*uuid.UUID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Record values are stored deflated behind a header which JSON can never
+// start with. Values without the header are plain JSON, like every value
+// written before compression existed, so both can be read.
+var compressedHeader = []byte{0, 'z'}
+
+// The byte after the header names the codec. Codecs can be added but never
+// changed, or records written with them can't be read anymore.
+const (
+	// deflate primed with compressionDict
+	codecFlateDict byte = 1
+)
+
+const currentCodec = codecFlateDict
+
+// values smaller than this are not worth compressing
+const compressMinSize = 128
+
+// compressionDict primes the compressor with what records, and the tab JSON
+// in their Contents, look like. Common strings go last, as they are cheaper
+// to refer to there. It must never change, see codecFlateDict.
+const compressionDict = `{"Schema":1,"Name":"","Password":"","Admin":false,"Tabs":[],"Usage":{"Tabs":0,"Bytes":0}}` +
+	`{"Schema":1,"Id":"","Tab":"","Author":"","Timestamp":"","Size":0,"Owner":"","Public":false,` +
+	`"CreatedAt":"","UpdatedAt":"","LastEditedBy":"","ContentSize":0,"Contents":"` +
+	`{\"id\":\"\",\"config\":{\"startSections\":1,\"startMeasures\":4,\"startStrings\":6,\"startNotesPerMeasure\":8,` +
+	`\"stringNames\":[\"e\",\"B\",\"G\",\"D\",\"A\",\"E\"]},\"name\":\"New Tab\",\"capo\":0,\"sections\":[{\"name\":\"\",` +
+	`\"stringNames\":[\"e\",\"B\",\"G\",\"D\",\"A\",\"E\"],\"measures\":[{\"beats\":8,\"strings\":[{\"notes\":[` +
+	`{\"fretNumber\":0},{\"fretNumber\":1},{\"fretNumber\":2},{\"fretNumber\":3},{\"fretNumber\":5},{\"fretNumber\":7},` +
+	`{\"fretNumber\":null},{\"fretNumber\":null},{\"fretNumber\":null},{\"fretNumber\":null}]}]}]}]}"}`
+
+func compressValue(val []byte) []byte {
+	if len(val) < compressMinSize {
+		return val
+	}
+
+	var b bytes.Buffer
+	b.Write(compressedHeader)
+	b.WriteByte(currentCodec)
+
+	w, err := flate.NewWriterDict(&b, flate.DefaultCompression, []byte(compressionDict))
+	if err != nil {
+		// only happens for invalid compression levels
+		panic(err)
+	}
+	_, _ = w.Write(val)
+	_ = w.Close()
+
+	// hardly compressible values are left alone
+	if b.Len() >= len(val) {
+		return val
+	}
+	return b.Bytes()
+}
+
+func isCompressed(val []byte) bool {
+	return bytes.HasPrefix(val, compressedHeader)
+}
+
+// decompressValue returns the plain value of a stored value.
+func decompressValue(val []byte) ([]byte, error) {
+	if !isCompressed(val) {
+		return val, nil
+	}
+
+	rest := val[len(compressedHeader):]
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("compressed value without codec")
+	}
+
+	switch rest[0] {
+	case codecFlateDict:
+		r := flate.NewReaderDict(bytes.NewReader(rest[1:]), []byte(compressionDict))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", rest[0])
+	}
+}
+
+// compressedPrefixes hold the records that are compressed, indexes are
+// left alone.
+var compressedPrefixes = []string{userPrefix, tabPrefix, revisionPrefix}
+
+type CompressionStats struct {
+	Records    int
+	Compressed int
+	// the size of the records before and after compression
+	PlainBytes  int
+	StoredBytes int
+}
+
+// Ratio is how many times smaller the records are stored.
+func (c CompressionStats) Ratio() float64 {
+	if c.StoredBytes == 0 {
+		return 1
+	}
+	return float64(c.PlainBytes) / float64(c.StoredBytes)
+}
+
+func (c CompressionStats) String() string {
+	return fmt.Sprintf("%d of %d records compressed, %d bytes stored as %d (%.2fx)",
+		c.Compressed, c.Records, c.PlainBytes, c.StoredBytes, c.Ratio())
+}
+
+// CompressionStats measures how well the stored records compress.
+func (s Store) CompressionStats() (CompressionStats, error) {
+	var res CompressionStats
+	err := s.db.View(func(txn Txn) error {
+		for _, p := range compressedPrefixes {
+			err := txn.Iterate([]byte(p), false, func(key []byte, val []byte) error {
+				plain, err := decompressValue(val)
+				if err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+
+				res.Records += 1
+				if isCompressed(val) {
+					res.Compressed += 1
+				}
+				res.PlainBytes += len(plain)
+				res.StoredBytes += len(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Recompress rewrites the records which were stored before compression, or
+// with an older codec. It returns the number of rewritten records.
+func (s Store) Recompress() (int, error) {
+	var keys [][]byte
+	err := s.db.View(func(txn Txn) error {
+		for _, p := range compressedPrefixes {
+			err := txn.Iterate([]byte(p), false, func(key []byte, val []byte) error {
+				if isCompressed(val) && len(val) > len(compressedHeader) && val[len(compressedHeader)] == currentCodec {
+					return nil
+				}
+				if !isCompressed(val) && len(val) < compressMinSize {
+					return nil
+				}
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = batchUpdate(s.db, keys, rewriteBatchSize, func(txn Txn, key []byte) error {
+		val, err := txn.Get(key)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		plain, err := decompressValue(val)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		res := compressValue(plain)
+		if bytes.Equal(res, val) {
+			return nil
+		}
+		n += 1
+		return txn.Set(key, res)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// StartRecompress compresses the records written before compression in the
+// background, so starting the server isn't held up by it. The returned
+// function waits for it to finish.
+func (s Store) StartRecompress() (wait func()) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		start := time.Now()
+		n, err := s.Recompress()
+		if err != nil {
+			log.Printf("compressing records: %v", err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+
+		stats, err := s.CompressionStats()
+		if err != nil {
+			log.Printf("compressing records: %v", err)
+			return
+		}
+		log.Printf("compressed %d records in %v, %s", n, time.Since(start), stats)
+	}()
+
+	return func() {
+		<-done
+	}
+}
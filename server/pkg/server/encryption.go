@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrWrongKey = errors.New("wrong encryption key, the store was encrypted with another key")
+var ErrEncrypted = errors.New("the store is encrypted, set ENCRYPTION_KEY_FILE or ENCRYPTION_KEY to open it")
+var ErrNotEncrypted = errors.New("the store is not encrypted")
+
+// Values are encrypted with a random data key, which is stored in the
+// database encrypted with the master key given by the administrator
+// (envelope encryption). Changing the master key then only means storing
+// the data key again, while rotate-key also replaces the data key.
+//
+// Only values are encrypted. Keys, which hold usernames, tab ids and times,
+// are stored as they are so they can still be iterated in order. The words
+// of the search index and the tags in the owner tag index would give away
+// the names and tags of private tabs, so they are blinded: replaced by an
+// HMAC under an index key, which is kept like the data keys. Blinded words
+// can only be looked up whole, see Store.Search and Store.SuggestTags.
+//
+// This happens above the Backend, so it covers badger, sqlite and memory
+// stores alike. None of them encrypt anything on their own: badger 1.6 has
+// no encryption at rest.
+const encryptionMetaKey = "meta_encryption"
+
+// encrypted values: header, id of the data key (4 bytes), nonce, ciphertext
+var encryptedHeader = []byte{0, 'e'}
+
+const encryptionKeySize = 32
+
+type encryptionMeta struct {
+	Current uint32
+	// data keys, encrypted with the master key
+	Keys map[uint32][]byte
+	// the key index words are blinded with, encrypted with the master key
+	IndexKey []byte
+}
+
+// EncryptedBackend encrypts the values stored in another backend.
+type EncryptedBackend struct {
+	inner    Backend
+	master   cipher.AEAD
+	keys     map[uint32]dataKey
+	current  uint32
+	indexKey []byte
+}
+
+type dataKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseEncryptionKey accepts a key of 32 raw bytes, or encoded as hex or
+// base64.
+func ParseEncryptionKey(b []byte) ([]byte, error) {
+	if len(b) == encryptionKeySize {
+		return b, nil
+	}
+
+	s := string(bytes.TrimSpace(b))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("an encryption key must be %d bytes, optionally hex or base64 encoded", encryptionKeySize)
+}
+
+// encryptionKey reads the master key from the file in ENCRYPTION_KEY_FILE or
+// from ENCRYPTION_KEY. It returns nil when neither is set.
+func encryptionKey() ([]byte, error) {
+	if file := os.Getenv("ENCRYPTION_KEY_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseEncryptionKey(b)
+	}
+
+	if env := os.Getenv("ENCRYPTION_KEY"); env != "" {
+		return ParseEncryptionKey([]byte(env))
+	}
+
+	return nil, nil
+}
+
+// withEncryption wraps backend in an EncryptedBackend when a key is
+// configured, and makes sure an encrypted store isn't opened without one.
+// The backend is closed when it can't be opened.
+func withEncryption(backend Backend) (Backend, error) {
+	key, err := encryptionKey()
+	if err == nil && key == nil {
+		err = checkUnencrypted(backend)
+		if err == nil {
+			return backend, nil
+		}
+	}
+
+	var res Backend
+	if err == nil {
+		res, err = OpenEncryptedBackend(backend, key)
+	}
+	if err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+func checkUnencrypted(backend Backend) error {
+	return backend.View(func(txn Txn) error {
+		_, err := txn.Get([]byte(encryptionMetaKey))
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return ErrEncrypted
+	})
+}
+
+func dataKeyAD(id uint32) []byte {
+	return []byte(fmt.Sprintf("data key %d", id))
+}
+
+var indexKeyAD = []byte("index key")
+
+// OpenEncryptedBackend encrypts the values written to inner with master.
+// A store that wasn't encrypted before gets a data key, the values already
+// in it stay readable until rotate-key encrypts them. It fails with
+// ErrWrongKey when the store was encrypted with another master key.
+func OpenEncryptedBackend(inner Backend, master []byte) (*EncryptedBackend, error) {
+	if len(master) != encryptionKeySize {
+		return nil, fmt.Errorf("an encryption key must be %d bytes", encryptionKeySize)
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &EncryptedBackend{
+		inner:  inner,
+		master: aead,
+		keys:   map[uint32]dataKey{},
+	}
+
+	var meta encryptionMeta
+	err = inner.View(func(txn Txn) error {
+		return getJSON(txn, []byte(encryptionMetaKey), &meta)
+	})
+	if err == ErrNotFound {
+		meta, err = b.addDataKey(encryptionMeta{Keys: map[uint32][]byte{}})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for id, wrapped := range meta.Keys {
+		if len(wrapped) < aead.NonceSize() {
+			return nil, fmt.Errorf("data key %d is corrupt", id)
+		}
+		key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], dataKeyAD(id))
+		if err != nil {
+			return nil, ErrWrongKey
+		}
+		keyAEAD, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		b.keys[id] = dataKey{key, keyAEAD}
+	}
+	b.current = meta.Current
+
+	if meta.IndexKey == nil {
+		err = b.addIndexKey(meta)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	if len(meta.IndexKey) < aead.NonceSize() {
+		return nil, errors.New("index key is corrupt")
+	}
+	b.indexKey, err = aead.Open(nil, meta.IndexKey[:aead.NonceSize()], meta.IndexKey[aead.NonceSize():], indexKeyAD)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+
+	return b, nil
+}
+
+// addIndexKey generates the index key and stores meta with it. Indexes
+// written before hold their words as they are, so they are marked out of
+// date and rebuilt when the server starts.
+func (b *EncryptedBackend) addIndexKey(meta encryptionMeta) error {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	meta.IndexKey = b.wrap(indexKeyAD, key)
+	b.indexKey = key
+
+	return b.inner.Update(func(txn Txn) error {
+		if err := txn.Delete([]byte(indexVersionKey)); err != nil {
+			return err
+		}
+		return setJSON(txn, []byte(encryptionMetaKey), &meta)
+	})
+}
+
+// addDataKey generates a new data key, makes it the current one and stores
+// meta with it.
+func (b *EncryptedBackend) addDataKey(meta encryptionMeta) (encryptionMeta, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return meta, err
+	}
+
+	var id uint32
+	for existing := range meta.Keys {
+		if existing > id {
+			id = existing
+		}
+	}
+	id += 1
+
+	meta.Keys[id] = b.wrap(dataKeyAD(id), key)
+	meta.Current = id
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return meta, err
+	}
+	b.keys[id] = dataKey{key, aead}
+	b.current = id
+
+	return meta, b.inner.Update(func(txn Txn) error {
+		return setJSON(txn, []byte(encryptionMetaKey), &meta)
+	})
+}
+
+// wrap encrypts a data key or the index key with the master key.
+func (b *EncryptedBackend) wrap(ad []byte, key []byte) []byte {
+	nonce := make([]byte, b.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return b.master.Seal(nonce, nonce, key, ad)
+}
+
+// blindIndexText replaces a word in an index key by its HMAC. Equal words
+// still give equal keys, but they no longer sort like the words.
+func (b *EncryptedBackend) blindIndexText(text string) string {
+	mac := hmac.New(sha256.New, b.indexKey)
+	_, _ = mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// indexBlinder is implemented by the backends and transactions that blind
+// the words in index keys.
+type indexBlinder interface {
+	blindIndexText(text string) string
+}
+
+// indexText returns a word as it is stored in the index keys of db, a
+// Backend or a Txn, and whether it was blinded.
+func indexText(db interface{}, text string) (string, bool) {
+	if b, ok := db.(indexBlinder); ok {
+		return b.blindIndexText(text), true
+	}
+	return text, false
+}
+
+// Unwrap returns the backend the encrypted values are stored in.
+func (b *EncryptedBackend) Unwrap() Backend {
+	return b.inner
+}
+
+func (b *EncryptedBackend) View(fn func(txn Txn) error) error {
+	return b.inner.View(func(txn Txn) error {
+		return fn(encryptedTxn{txn, b})
+	})
+}
+
+func (b *EncryptedBackend) Update(fn func(txn Txn) error) error {
+	return b.inner.Update(func(txn Txn) error {
+		return fn(encryptedTxn{txn, b})
+	})
+}
+
+func (b *EncryptedBackend) Close() error {
+	return b.inner.Close()
+}
+
+// encrypt seals a value with the current data key. The key of the record is
+// authenticated with it, so values can't be moved to another key.
+func (b *EncryptedBackend) encrypt(key []byte, value []byte) []byte {
+	aead := b.keys[b.current].aead
+
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], b.current)
+
+	res := make([]byte, 0, len(encryptedHeader)+len(id)+aead.NonceSize()+len(value)+aead.Overhead())
+	res = append(res, encryptedHeader...)
+	res = append(res, id[:]...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	res = append(res, nonce...)
+
+	return aead.Seal(res, nonce, value, key)
+}
+
+// decrypt opens an encrypted value. Values written before the store was
+// encrypted are returned as they are.
+func (b *EncryptedBackend) decrypt(key []byte, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedHeader) {
+		return value, nil
+	}
+
+	rest := value[len(encryptedHeader):]
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("%s: truncated encrypted value", key)
+	}
+	id := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	dk, ok := b.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: encrypted with unknown data key %d", key, id)
+	}
+	aead := dk.aead
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s: truncated encrypted value", key)
+	}
+
+	res, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return res, nil
+}
+
+// plainValue tells whether a value is stored as it is: the encryption
+// metadata itself, and empty values such as those of index keys.
+func (b *EncryptedBackend) plainValue(key []byte, value []byte) bool {
+	return len(value) == 0 || string(key) == encryptionMetaKey
+}
+
+type encryptedTxn struct {
+	txn Txn
+	b   *EncryptedBackend
+}
+
+func (t encryptedTxn) Get(key []byte) ([]byte, error) {
+	value, err := t.txn.Get(key)
+	if err != nil || t.b.plainValue(key, value) {
+		return value, err
+	}
+	return t.b.decrypt(key, value)
+}
+
+func (t encryptedTxn) Set(key []byte, value []byte) error {
+	if !t.b.plainValue(key, value) {
+		value = t.b.encrypt(key, value)
+	}
+	return t.txn.Set(key, value)
+}
+
+func (t encryptedTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t encryptedTxn) Iterate(prefix []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.IterateAfter(prefix, nil, reverse, fn)
+}
+
+func (t encryptedTxn) IterateAfter(prefix []byte, start []byte, reverse bool, fn func(key []byte, value []byte) error) error {
+	return t.txn.IterateAfter(prefix, start, reverse, func(key []byte, value []byte) error {
+		if !t.b.plainValue(key, value) {
+			var err error
+			value, err = t.b.decrypt(key, value)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(key, value)
+	})
+}
+
+func (t encryptedTxn) IterateKeys(prefix []byte, fn func(key []byte) error) error {
+	return t.txn.IterateKeys(prefix, fn)
+}
+
+func (t encryptedTxn) blindIndexText(text string) string {
+	return t.b.blindIndexText(text)
+}
+
+// RotateKey encrypts everything with a new data key, and stores that key
+// encrypted with newMaster, or the current master key when it is nil. The
+// index key stays the same, so the indexes don't have to be rebuilt.
+// Values written before the store was encrypted are encrypted as well.
+// When it is interrupted the store can still be opened with the old master
+// key, and rotating again finishes the job. It returns the number of
+// re-encrypted values.
+func (b *EncryptedBackend) RotateKey(newMaster []byte) (int, error) {
+	var meta encryptionMeta
+	err := b.inner.View(func(txn Txn) error {
+		return getJSON(txn, []byte(encryptionMetaKey), &meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	meta, err = b.addDataKey(meta)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys [][]byte
+	err = b.inner.View(func(txn Txn) error {
+		return txn.Iterate(nil, false, func(key []byte, value []byte) error {
+			if !b.plainValue(key, value) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = batchUpdate(b, keys, rewriteBatchSize, func(txn Txn, key []byte) error {
+		value, err := txn.Get(key)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n += 1
+		return txn.Set(key, value)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	// only the new data key is in use now
+	if newMaster != nil {
+		if len(newMaster) != encryptionKeySize {
+			return n, fmt.Errorf("an encryption key must be %d bytes", encryptionKeySize)
+		}
+		b.master, err = newAEAD(newMaster)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	current := b.keys[b.current]
+	b.keys = map[uint32]dataKey{b.current: current}
+	meta = encryptionMeta{
+		Current: b.current,
+		Keys: map[uint32][]byte{
+			b.current: b.wrap(dataKeyAD(b.current), current.key),
+		},
+		IndexKey: b.wrap(indexKeyAD, b.indexKey),
+	}
+
+	return n, b.inner.Update(func(txn Txn) error {
+		return setJSON(txn, []byte(encryptionMetaKey), &meta)
+	})
+}
+
+// RotateKey re-encrypts the store with a new data key, see
+// EncryptedBackend.RotateKey.
+func (s Store) RotateKey(newMaster []byte) (int, error) {
+	b, ok := s.db.(*EncryptedBackend)
+	if !ok {
+		return 0, ErrNotEncrypted
+	}
+	return b.RotateKey(newMaster)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, encryptionKeySize)
+}
+
+func openEncrypted(t *testing.T, inner Backend, key []byte) *EncryptedBackend {
+	t.Helper()
+	b, err := OpenEncryptedBackend(inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func rawValue(t *testing.T, b Backend, key string) []byte {
+	t.Helper()
+	var res []byte
+	err := b.View(func(txn Txn) error {
+		var err error
+		res, err = txn.Get([]byte(key))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	inner := NewMemoryBackend()
+	b := openEncrypted(t, inner, testKey(1))
+
+	set(t, b, "tab_a", "secret contents", "tab_b", "more", "idx_x", "")
+
+	if v, err := get(t, b, "tab_a"); err != nil || v != "secret contents" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if raw := rawValue(t, inner, "tab_a"); bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("the value is stored as it is: %q", raw)
+	}
+	if raw := rawValue(t, inner, "idx_x"); len(raw) != 0 {
+		t.Errorf("an empty value is stored as %q", raw)
+	}
+
+	want := []string{"tab_a=secret contents", "tab_b=more"}
+	if got := keys(t, b, "tab_", "", false); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("iterated %q, want %q", got, want)
+	}
+
+	// reopened with the same key
+	b = openEncrypted(t, inner, testKey(1))
+	if v, err := get(t, b, "tab_b"); err != nil || v != "more" {
+		t.Fatalf("get after reopening: %q, %v", v, err)
+	}
+}
+
+func TestEncryptedValueBoundToKey(t *testing.T) {
+	inner := NewMemoryBackend()
+	b := openEncrypted(t, inner, testKey(1))
+	set(t, b, "tab_a", "a")
+
+	// a value copied to another key doesn't decrypt
+	raw := rawValue(t, inner, "tab_a")
+	set(t, inner, "tab_b", string(raw))
+	if _, err := get(t, b, "tab_b"); err == nil {
+		t.Error("a value moved to another key was decrypted")
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	inner := NewMemoryBackend()
+	b := openEncrypted(t, inner, testKey(1))
+	set(t, b, "tab_a", "a")
+
+	if _, err := OpenEncryptedBackend(inner, testKey(2)); err != ErrWrongKey {
+		t.Errorf("opening with another key: %v, want ErrWrongKey", err)
+	}
+	if err := checkUnencrypted(inner); err != ErrEncrypted {
+		t.Errorf("opening without a key: %v, want ErrEncrypted", err)
+	}
+}
+
+func TestEncryptedExistingValues(t *testing.T) {
+	inner := NewMemoryBackend()
+	set(t, inner, "tab_a", "plain")
+
+	b := openEncrypted(t, inner, testKey(1))
+	if v, err := get(t, b, "tab_a"); err != nil || v != "plain" {
+		t.Fatalf("get of a value from before encryption: %q, %v", v, err)
+	}
+
+	n, err := b.RotateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("rotate-key encrypted %d values, want 1", n)
+	}
+	if raw := rawValue(t, inner, "tab_a"); bytes.Contains(raw, []byte("plain")) {
+		t.Errorf("the value is still stored as it is after rotate-key: %q", raw)
+	}
+	if v, err := get(t, b, "tab_a"); err != nil || v != "plain" {
+		t.Fatalf("get after rotate-key: %q, %v", v, err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	inner := NewMemoryBackend()
+	b := openEncrypted(t, inner, testKey(1))
+	set(t, b, "tab_a", "a", "tab_b", "b")
+	before := rawValue(t, inner, "tab_a")
+	term, _ := indexText(b, "term")
+
+	n, err := b.RotateKey(testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("rotate-key re-encrypted %d values, want 2", n)
+	}
+	if bytes.Equal(rawValue(t, inner, "tab_a"), before) {
+		t.Error("the value was not re-encrypted")
+	}
+
+	if _, err := OpenEncryptedBackend(inner, testKey(1)); err != ErrWrongKey {
+		t.Errorf("opening with the old key: %v, want ErrWrongKey", err)
+	}
+
+	b = openEncrypted(t, inner, testKey(2))
+	if v, err := get(t, b, "tab_a"); err != nil || v != "a" {
+		t.Fatalf("get after reopening with the new key: %q, %v", v, err)
+	}
+	if v, err := get(t, b, "tab_b"); err != nil || v != "b" {
+		t.Fatalf("get after reopening with the new key: %q, %v", v, err)
+	}
+	if len(b.keys) != 1 {
+		t.Errorf("%d data keys left after rotate-key, want 1", len(b.keys))
+	}
+
+	// the indexes stay valid
+	if after, _ := indexText(b, "term"); after != term {
+		t.Errorf("index text changed from %q to %q by rotate-key", term, after)
+	}
+}
+
+func TestBlindedIndexText(t *testing.T) {
+	inner := NewMemoryBackend()
+	if text, blinded := indexText(inner, "term"); blinded || text != "term" {
+		t.Errorf("an unencrypted store blinds %q to %q", "term", text)
+	}
+
+	set(t, inner, indexVersionKey, "1")
+	b := openEncrypted(t, inner, testKey(1))
+	if _, err := get(t, inner, indexVersionKey); err != ErrNotFound {
+		t.Errorf("the index version is kept when the index key is added: %v", err)
+	}
+
+	term, blinded := indexText(b, "term")
+	if !blinded || term == "term" || bytes.Contains([]byte(term), []byte("term")) {
+		t.Errorf("%q is blinded to %q", "term", term)
+	}
+	if other, _ := indexText(b, "other"); other == term {
+		t.Error("different words are blinded the same")
+	}
+
+	err := b.View(func(txn Txn) error {
+		if text, _ := indexText(txn, "term"); text != term {
+			t.Errorf("the transaction blinds to %q, the backend to %q", text, term)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = openEncrypted(t, inner, testKey(1))
+	if again, _ := indexText(b, "term"); again != term {
+		t.Errorf("blinded to %q after reopening, was %q", again, term)
+	}
+
+	other := openEncrypted(t, NewMemoryBackend(), testKey(1))
+	if elsewhere, _ := indexText(other, "term"); elsewhere == term {
+		t.Error("another store blinds with the same index key")
+	}
+}
@@ -0,0 +1,809 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An export is a gzipped tar archive which does not depend on the backend:
+//
+//	manifest.json            ExportManifest, always the first file
+//	users.jsonl              one user per line
+//	collections.jsonl        one collection per line
+//	tabs/<id>.json           one file per tab
+//	revisions/<id>.jsonl     the revisions of a tab, one per line
+//	stars.jsonl              the favorites of all users, one star per line
+//	transfers.jsonl          pending transfers, one per line
+//	audit.jsonl              the audit trail of all tabs, one entry per line
+//
+// Records are written with the schema version in the manifest, and
+// upgraded with the migrations when they are imported into a newer version.
+const exportFormat = 1
+
+const (
+	ImportMerge   = "merge"
+	ImportReplace = "replace"
+)
+
+// What happens with an imported user when a user with that name exists,
+// in ImportMerge mode.
+const (
+	// the imported user gets another name, and keeps their tabs
+	CollisionRename = "rename"
+	// the imported user and their tabs are not imported
+	CollisionSkip = "skip"
+)
+
+var ErrInvalidExport = errors.New("not an ainulindale export")
+
+type ExportManifest struct {
+	Format  int
+	Created time.Time
+	// schema version of the records per key prefix
+	Schemas      map[string]int
+	Users        int
+	Collections  int
+	Tabs         int
+	Revisions    int
+	Stars        int
+	Transfers    int
+	AuditEntries int
+}
+
+func (m ExportManifest) String() string {
+	return fmt.Sprintf("%d users, %d collections, %d tabs, %d revisions, %d stars, %d transfers, %d audit entries", m.Users, m.Collections, m.Tabs, m.Revisions, m.Stars, m.Transfers, m.AuditEntries)
+}
+
+// exportedStar is a star in stars.jsonl, which is stored as both a star_
+// and a starred_ key.
+type exportedStar struct {
+	User    string
+	Tab     uuid.UUID
+	Starred time.Time
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modified time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// writeRecords writes the records with prefix p to a file with one record
+// per line. record decodes a record, nil leaves it out.
+func writeRecords(txn Txn, tw *tar.Writer, name string, p string, modified time.Time, record func(key []byte, val []byte) (interface{}, error)) error {
+	var buf bytes.Buffer
+	err := txn.Iterate([]byte(p), false, func(key []byte, val []byte) error {
+		v, err := record(key, val)
+		if err != nil || v == nil {
+			return err
+		}
+		return json.NewEncoder(&buf).Encode(v)
+	})
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, name, buf.Bytes(), modified)
+}
+
+// Export writes all users, collections, tabs, revisions, stars, transfers and the audit trail to w, as they are at a single
+// point in time.
+func (s Store) Export(w io.Writer) (ExportManifest, error) {
+	manifest := ExportManifest{
+		Format:  exportFormat,
+		Created: time.Now(),
+		Schemas: map[string]int{},
+	}
+	for p := range migrations {
+		manifest.Schemas[p] = schemaVersion(p)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := s.db.View(func(txn Txn) error {
+		// count first, the manifest comes first in the archive
+		counts := map[string]*int{
+			userPrefix:       &manifest.Users,
+			collectionPrefix: &manifest.Collections,
+			tabPrefix:        &manifest.Tabs,
+			revisionPrefix:   &manifest.Revisions,
+			starredPrefix:    &manifest.Stars,
+			transferPrefix:   &manifest.Transfers,
+			auditPrefix:      &manifest.AuditEntries,
+		}
+		for p, n := range counts {
+			n := n
+			err := txn.IterateKeys([]byte(p), func(_ []byte) error {
+				*n += 1
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b, err := json.MarshalIndent(&manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "manifest.json", b, manifest.Created); err != nil {
+			return err
+		}
+
+		err = writeRecords(txn, tw, "users.jsonl", userPrefix, manifest.Created, func(key []byte, val []byte) (interface{}, error) {
+			var user User
+			if err := decodeJSON(key, val, &user); err != nil {
+				return nil, err
+			}
+			// usage is counted again after importing
+			user.Usage = nil
+			return &user, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// collections come before the tabs in them
+		err = writeRecords(txn, tw, "collections.jsonl", collectionPrefix, manifest.Created, func(key []byte, val []byte) (interface{}, error) {
+			var c Collection
+			err := decodeJSON(key, val, &c)
+			return &c, err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Iterate([]byte(tabPrefix), false, func(key []byte, val []byte) error {
+			var tab Tab
+			if err := decodeJSON(key, val, &tab); err != nil {
+				return err
+			}
+			b, err := json.MarshalIndent(&tab, "", "  ")
+			if err != nil {
+				return err
+			}
+			return writeTarFile(tw, "tabs/"+tab.Id.String()+".json", b, tab.UpdatedAt)
+		})
+		if err != nil {
+			return err
+		}
+
+		// revisions are sorted by tab, so each file is written in one go
+		var revisions bytes.Buffer
+		var current uuid.UUID
+		flush := func() error {
+			if revisions.Len() == 0 {
+				return nil
+			}
+			err := writeTarFile(tw, "revisions/"+current.String()+".jsonl", revisions.Bytes(), manifest.Created)
+			revisions.Reset()
+			return err
+		}
+		err = txn.Iterate([]byte(revisionPrefix), false, func(key []byte, val []byte) error {
+			var rev Revision
+			if err := decodeJSON(key, val, &rev); err != nil {
+				return err
+			}
+			if rev.Tab != current {
+				if err := flush(); err != nil {
+					return err
+				}
+				current = rev.Tab
+			}
+			return json.NewEncoder(&revisions).Encode(&rev)
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		// stars, transfers and the audit trail come after the tabs they
+		// refer to
+		err = writeRecords(txn, tw, "stars.jsonl", starredPrefix, manifest.Created, func(key []byte, val []byte) (interface{}, error) {
+			// starred_<tab>\x00<user>, holding the time it was starred
+			rest := key[len(starredPrefix):]
+			if len(rest) < 37 || rest[36] != 0 {
+				return nil, fmt.Errorf("invalid star %q", key)
+			}
+			id, err := uuid.ParseBytes(rest[:36])
+			if err != nil {
+				return nil, fmt.Errorf("invalid star %q", key)
+			}
+			nanos, err := strconv.ParseInt(string(val), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid star %q: %v", key, err)
+			}
+			return &exportedStar{
+				User:    string(rest[37:]),
+				Tab:     id,
+				Starred: time.Unix(0, nanos).UTC(),
+			}, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = writeRecords(txn, tw, "transfers.jsonl", transferPrefix, manifest.Created, func(key []byte, val []byte) (interface{}, error) {
+			var transfer Transfer
+			err := decodeJSON(key, val, &transfer)
+			return &transfer, err
+		})
+		if err != nil {
+			return err
+		}
+		return writeRecords(txn, tw, "audit.jsonl", auditPrefix, manifest.Created, func(key []byte, val []byte) (interface{}, error) {
+			var entry AuditEntry
+			err := decodeJSON(key, val, &entry)
+			return &entry, err
+		})
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+type ImportOptions struct {
+	// ImportMerge adds to what is in the store, ImportReplace deletes
+	// everything in the store first.
+	Mode string
+	// CollisionRename or CollisionSkip
+	OnCollision string
+}
+
+type ImportReport struct {
+	Manifest     ExportManifest
+	Users        int
+	Collections  int
+	Tabs         int
+	Revisions    int
+	Stars        int
+	Transfers    int
+	AuditEntries int
+	// imported users which got another name, old name to new name
+	Renamed map[string]string
+	// users, collections and tabs, which were not imported because they
+	// already exist
+	SkippedUsers       []string
+	SkippedCollections []uuid.UUID
+	SkippedTabs        []uuid.UUID
+}
+
+func (r ImportReport) String() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "imported %d users, %d collections, %d tabs, %d revisions, %d stars, %d transfers and %d audit entries", r.Users, r.Collections, r.Tabs, r.Revisions, r.Stars, r.Transfers, r.AuditEntries)
+	for old, name := range r.Renamed {
+		_, _ = fmt.Fprintf(&b, "\n  renamed user %s to %s", old, name)
+	}
+	for _, name := range r.SkippedUsers {
+		_, _ = fmt.Fprintf(&b, "\n  skipped existing user %s and their tabs", name)
+	}
+	for _, id := range r.SkippedCollections {
+		_, _ = fmt.Fprintf(&b, "\n  skipped existing collection %s", id)
+	}
+	for _, id := range r.SkippedTabs {
+		_, _ = fmt.Fprintf(&b, "\n  skipped existing tab %s", id)
+	}
+	return b.String()
+}
+
+// decodeImported decodes a record from an export as if it was stored under
+// key, upgrading it to the current schema.
+func decodeImported(key []byte, data []byte, v interface{}) error {
+	data, _, err := upgradeRecord(key, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Import reads an archive written by Export. The indexes are rebuilt
+// afterwards, quotas are not enforced.
+func (s Store) Import(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if options.Mode != ImportMerge && options.Mode != ImportReplace {
+		return nil, fmt.Errorf("unknown import mode %q", options.Mode)
+	}
+	if options.OnCollision == "" {
+		options.OnCollision = CollisionRename
+	}
+	if options.OnCollision != CollisionRename && options.OnCollision != CollisionSkip {
+		return nil, fmt.Errorf("unknown collision handling %q", options.OnCollision)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	tr := tar.NewReader(gz)
+
+	report := &ImportReport{
+		Renamed: map[string]string{},
+	}
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "manifest.json" {
+		return nil, ErrInvalidExport
+	}
+	if err := json.NewDecoder(tr).Decode(&report.Manifest); err != nil {
+		return nil, ErrInvalidExport
+	}
+	if report.Manifest.Format != exportFormat {
+		return nil, fmt.Errorf("export format %d is not supported", report.Manifest.Format)
+	}
+	for p, version := range report.Manifest.Schemas {
+		if version > schemaVersion(p) {
+			return nil, fmt.Errorf("the export has %s records with schema version %d, newer than the supported %d", p, version, schemaVersion(p))
+		}
+	}
+
+	if options.Mode == ImportReplace {
+		if err := s.clear(); err != nil {
+			return nil, err
+		}
+	}
+
+	// imported name to the name in the store, users who were skipped map to ""
+	names := map[string]string{}
+	// the tabs of every imported user, in their original order
+	userTabs := map[string][]uuid.UUID{}
+	// tabs in the export, and whether they were imported
+	imported := map[uuid.UUID]bool{}
+	// tabs of users who are not in the export
+	adopted := map[string][]uuid.UUID{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		switch dir, file := path.Split(hdr.Name); {
+		case hdr.Name == "users.jsonl":
+			err = s.importUsers(tr, options, names, userTabs, report)
+		case hdr.Name == "collections.jsonl":
+			err = s.importCollections(tr, names, report)
+		case dir == "tabs/" && strings.HasSuffix(file, ".json"):
+			err = s.importTab(tr, names, imported, adopted, report)
+		case dir == "revisions/" && strings.HasSuffix(file, ".jsonl"):
+			err = s.importRevisions(tr, imported, report)
+		case hdr.Name == "stars.jsonl":
+			err = s.importStars(tr, names, report)
+		case hdr.Name == "transfers.jsonl":
+			err = s.importTransfers(tr, names, imported, report)
+		case hdr.Name == "audit.jsonl":
+			err = s.importAudit(tr, names, imported, report)
+		default:
+			err = fmt.Errorf("unexpected file %s", hdr.Name)
+		}
+		if err != nil {
+			return report, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+
+	// users list the tabs that made it, their usage is counted again
+	for name, tabs := range userTabs {
+		err := s.db.Update(func(txn Txn) error {
+			var user User
+			if err := getJSON(txn, prefix(userPrefix, name), &user); err != nil {
+				return err
+			}
+
+			user.Tabs = []uuid.UUID{}
+			for _, id := range tabs {
+				if imported[id] {
+					user.Tabs = append(user.Tabs, id)
+				}
+			}
+			user.Usage = nil
+			return setJSON(txn, prefix(userPrefix, name), &user)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for name, tabs := range adopted {
+		err := s.db.Update(func(txn Txn) error {
+			var user User
+			err := getJSON(txn, prefix(userPrefix, name), &user)
+			if err == ErrNotFound {
+				// a deleted user, whose tabs are in the trash
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			user.Tabs = append(user.Tabs, tabs...)
+			user.Usage = nil
+			return setJSON(txn, prefix(userPrefix, name), &user)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	_, err = s.RebuildIndexes()
+	return report, err
+}
+
+// clear deletes every record and index, everything but the encryption key.
+func (s Store) clear() error {
+	var keys [][]byte
+	err := s.db.View(func(txn Txn) error {
+		return txn.IterateKeys(nil, func(key []byte) error {
+			if string(key) != encryptionMetaKey {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return batchUpdate(s.db, keys, deleteBatchSize, deleteKey)
+}
+
+// freeName finds a name like name-2 that is not used yet.
+func freeName(txn Txn, name string) (string, error) {
+	for i := 2; ; i++ {
+		res := fmt.Sprintf("%s-%d", name, i)
+		_, err := txn.Get(prefix(userPrefix, res))
+		if err == ErrNotFound {
+			return res, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s Store) importUsers(r io.Reader, options ImportOptions, names map[string]string, userTabs map[string][]uuid.UUID, report *ImportReport) error {
+	return scanLines(r, func(data []byte) error {
+		var user User
+		err := decodeImported([]byte(userPrefix), data, &user)
+		if err != nil {
+			return err
+		}
+		if user.Name == "" || strings.ContainsRune(user.Name, 0) {
+			return fmt.Errorf("invalid username %q", user.Name)
+		}
+
+		return s.db.Update(func(txn Txn) error {
+			name := user.Name
+			_, err := txn.Get(prefix(userPrefix, name))
+			if err == nil {
+				if options.OnCollision == CollisionSkip {
+					names[user.Name] = ""
+					report.SkippedUsers = append(report.SkippedUsers, user.Name)
+					return nil
+				}
+				name, err = freeName(txn, name)
+				if err != nil {
+					return err
+				}
+				report.Renamed[user.Name] = name
+			} else if err != ErrNotFound {
+				return err
+			}
+
+			names[user.Name] = name
+			userTabs[name] = user.Tabs
+			report.Users += 1
+
+			user.Name = name
+			user.Tabs = nil
+			user.Usage = nil
+			return setJSON(txn, prefix(userPrefix, name), &user)
+		})
+	})
+}
+
+// importCollections imports the collections of imported users, with their
+// owner and the users they are shared with renamed.
+func (s Store) importCollections(r io.Reader, names map[string]string, report *ImportReport) error {
+	var collections []Collection
+	err := scanLines(r, func(data []byte) error {
+		var c Collection
+		if err := decodeImported([]byte(collectionPrefix), data, &c); err != nil {
+			return err
+		}
+		if c.Id == uuid.Nil {
+			return errors.New("collection without id")
+		}
+		if name, ok := names[c.Owner]; ok && name == "" {
+			// the owner was skipped
+			return nil
+		}
+		collections = append(collections, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the owners of the collections, parents may come after their children
+	owners := map[uuid.UUID]string{}
+	for _, c := range collections {
+		owners[c.Id] = renamed(names, c.Owner)
+	}
+
+	for i := range collections {
+		c := &collections[i]
+		c.Owner = renamed(names, c.Owner)
+
+		var shared []string
+		for _, name := range c.SharedWith {
+			// a user with this name who was skipped is someone else
+			if res, ok := names[name]; !ok || res != "" {
+				shared = append(shared, renamed(names, name))
+			}
+		}
+		c.SharedWith = shared
+
+		err := s.db.Update(func(txn Txn) error {
+			_, err := getCollection(txn, c.Id)
+			if err == nil {
+				report.SkippedCollections = append(report.SkippedCollections, c.Id)
+				return nil
+			}
+			if err != ErrCollectionNotFound {
+				return err
+			}
+
+			// the parent has to belong to the same user
+			if c.Parent != nil {
+				owner := owners[*c.Parent]
+				parent, err := getCollection(txn, *c.Parent)
+				if err == nil {
+					owner = parent.Owner
+				} else if err != ErrCollectionNotFound {
+					return err
+				}
+				if owner != c.Owner {
+					c.Parent = nil
+				}
+			}
+
+			report.Collections += 1
+			return setJSON(txn, collectionKey(c.Id), c)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Store) importTab(r io.Reader, names map[string]string, imported map[uuid.UUID]bool, adopted map[string][]uuid.UUID, report *ImportReport) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var tab Tab
+	if err := decodeImported([]byte(tabPrefix), data, &tab); err != nil {
+		return err
+	}
+	if tab.Id == uuid.Nil {
+		return errors.New("tab without id")
+	}
+
+	if name, ok := names[tab.Owner]; ok {
+		if name == "" {
+			// the owner was skipped
+			imported[tab.Id] = false
+			return nil
+		}
+		if tab.LastEditedBy == tab.Owner {
+			tab.LastEditedBy = name
+		}
+		tab.Owner = name
+	}
+	_, ownerImported := names[tab.Owner]
+
+	return s.db.Update(func(txn Txn) error {
+		_, err := txn.Get(prefix(tabPrefix, tab.Id.String()))
+		if err == nil {
+			imported[tab.Id] = false
+			report.SkippedTabs = append(report.SkippedTabs, tab.Id)
+			return nil
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		// the tab stays out of collections which were not imported
+		var collections []uuid.UUID
+		for _, id := range tab.Collections {
+			c, err := getCollection(txn, id)
+			if err != nil && err != ErrCollectionNotFound {
+				return err
+			}
+			if err == nil && c.Owner == tab.Owner {
+				collections = append(collections, id)
+			}
+		}
+		tab.Collections = collections
+
+		imported[tab.Id] = true
+		if !ownerImported {
+			adopted[tab.Owner] = append(adopted[tab.Owner], tab.Id)
+		}
+		report.Tabs += 1
+		return setJSON(txn, prefix(tabPrefix, tab.Id.String()), &tab)
+	})
+}
+
+func (s Store) importRevisions(r io.Reader, imported map[uuid.UUID]bool, report *ImportReport) error {
+	var revisions []Revision
+	err := scanLines(r, func(data []byte) error {
+		var rev Revision
+		if err := decodeImported([]byte(revisionPrefix), data, &rev); err != nil {
+			return err
+		}
+		// the revisions of skipped tabs
+		if imported[rev.Tab] {
+			revisions = append(revisions, rev)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn Txn) error {
+		for i := range revisions {
+			rev := &revisions[i]
+			if err := setJSON(txn, revisionKey(rev.Tab, rev.Id), rev); err != nil {
+				return err
+			}
+		}
+		report.Revisions += len(revisions)
+		return nil
+	})
+}
+
+// scanLines calls fn with every line of a .jsonl file that is not empty.
+func scanLines(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	// users list all their tabs, which makes for long lines
+	scanner.Buffer(nil, 64<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// renamed is the name of an imported user in the store. The names of users
+// who were skipped, or are not in the export, stay as they are.
+func renamed(names map[string]string, name string) string {
+	if res := names[name]; res != "" {
+		return res
+	}
+	return name
+}
+
+// importStars imports the stars of imported users, on tabs which are in the
+// store.
+func (s Store) importStars(r io.Reader, names map[string]string, report *ImportReport) error {
+	return scanLines(r, func(data []byte) error {
+		var star exportedStar
+		if err := json.Unmarshal(data, &star); err != nil {
+			return err
+		}
+		if name, ok := names[star.User]; ok && name == "" {
+			// the user was skipped
+			return nil
+		}
+		name := renamed(names, star.User)
+
+		return s.db.Update(func(txn Txn) error {
+			for _, key := range [][]byte{prefix(userPrefix, name), prefix(tabPrefix, star.Tab.String())} {
+				_, err := txn.Get(key)
+				if err == ErrNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err := txn.Get(starredKey(star.Tab, name))
+			if err != ErrNotFound {
+				// starred already
+				return err
+			}
+
+			starred := indexTime(star.Starred)
+			if err := txn.Set(starKey(name, starred, star.Tab), []byte{}); err != nil {
+				return err
+			}
+			report.Stars += 1
+			return txn.Set(starredKey(star.Tab, name), []byte(starred))
+		})
+	})
+}
+
+// importTransfers imports the pending transfers of imported tabs, between
+// users who were imported.
+func (s Store) importTransfers(r io.Reader, names map[string]string, imported map[uuid.UUID]bool, report *ImportReport) error {
+	return scanLines(r, func(data []byte) error {
+		var transfer Transfer
+		if err := decodeImported([]byte(transferPrefix), data, &transfer); err != nil {
+			return err
+		}
+		if !imported[transfer.Tab] || names[transfer.From] == "" || names[transfer.To] == "" {
+			return nil
+		}
+		transfer.From = names[transfer.From]
+		transfer.To = names[transfer.To]
+		transfer.By = renamed(names, transfer.By)
+
+		return s.db.Update(func(txn Txn) error {
+			report.Transfers += 1
+			return setJSON(txn, transferKey(transfer.Tab), &transfer)
+		})
+	})
+}
+
+// importAudit imports the audit trail of the imported tabs, and of purged
+// tabs which are not in the store.
+func (s Store) importAudit(r io.Reader, names map[string]string, imported map[uuid.UUID]bool, report *ImportReport) error {
+	return scanLines(r, func(data []byte) error {
+		var entry AuditEntry
+		if err := decodeImported([]byte(auditPrefix), data, &entry); err != nil {
+			return err
+		}
+		if done, ok := imported[entry.Tab]; ok && !done {
+			return nil
+		}
+		entry.From = renamed(names, entry.From)
+		entry.To = renamed(names, entry.To)
+		entry.By = renamed(names, entry.By)
+
+		return s.db.Update(func(txn Txn) error {
+			_, err := txn.Get(append(auditTabPrefix(entry.Tab), indexTime(entry.Time)...))
+			if err != ErrNotFound {
+				// already there, when merging into the store it came from
+				return err
+			}
+			report.AuditEntries += 1
+			return audit(txn, entry)
+		})
+	})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func newTestStore(t *testing.T, users ...string) *Store {
+	t.Helper()
+	s := NewStoreWithBackend(NewMemoryBackend())
+	t.Cleanup(s.Close)
+	for _, name := range users {
+		if err := s.UpdateUser(&User{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func newTestTab(t *testing.T, s *Store, owner string) *Tab {
+	t.Helper()
+	tab := &Tab{Id: uuid.New(), Owner: owner, Contents: "{}"}
+	if err := s.CreateTab(tab); err != nil {
+		t.Fatal(err)
+	}
+	return tab
+}
+
+func exportStore(t *testing.T, s *Store) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := s.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func importStore(t *testing.T, s *Store, export *bytes.Buffer, options ImportOptions) *ImportReport {
+	t.Helper()
+	report, err := s.Import(bytes.NewReader(export.Bytes()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestExportTransfers(t *testing.T) {
+	s := newTestStore(t, "alice", "bob")
+	offered := newTestTab(t, s, "alice")
+	given := newTestTab(t, s, "alice")
+	if _, err := s.OfferTab(offered.Id, "bob", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TransferTab(given.Id, "bob", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	export := exportStore(t, s)
+
+	other := newTestStore(t)
+	report := importStore(t, other, export, ImportOptions{Mode: ImportReplace})
+	if report.Manifest.Transfers != 1 || report.Manifest.AuditEntries != 2 {
+		t.Errorf("manifest counts %s, want 1 transfer and 2 audit entries", report.Manifest)
+	}
+	if report.Transfers != 1 || report.AuditEntries != 2 {
+		t.Errorf("imported %d transfers and %d audit entries, want 1 and 2", report.Transfers, report.AuditEntries)
+	}
+	if transfer, err := other.GetTransfer(offered.Id); err != nil || transfer.To != "bob" {
+		t.Errorf("transfer after import: %+v, %v", transfer, err)
+	}
+	if entries, err := other.GetAudit(given.Id); err != nil || len(entries) != 1 || entries[0].Action != AuditTransferred {
+		t.Errorf("audit after import: %+v, %v", entries, err)
+	}
+
+	// users who are renamed keep their transfers, the audit trail of
+	// tabs that are skipped is not imported twice
+	other = newTestStore(t, "bob")
+	report = importStore(t, other, export, ImportOptions{Mode: ImportMerge})
+	if transfer, err := other.GetTransfer(offered.Id); err != nil || transfer.From != "alice" || transfer.To != "bob-2" {
+		t.Errorf("transfer to a renamed user: %+v, %v", transfer, err)
+	}
+	report = importStore(t, other, export, ImportOptions{Mode: ImportMerge, OnCollision: CollisionSkip})
+	if report.Transfers != 0 || report.AuditEntries != 0 {
+		t.Errorf("imported %d transfers and %d audit entries again", report.Transfers, report.AuditEntries)
+	}
+	if entries, err := other.GetAudit(offered.Id); err != nil || len(entries) != 1 || entries[0].To != "bob-2" {
+		t.Errorf("audit of a renamed user: %+v, %v", entries, err)
+	}
+}
+
+func TestExportCollections(t *testing.T) {
+	s := newTestStore(t, "alice", "bob")
+	songs, err := s.CreateCollection("alice", "songs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := s.CreateCollection("alice", "nested", &songs.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ShareCollection(songs.Id, false, []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	tab := newTestTab(t, s, "alice")
+	if err := s.MoveTabs("alice", []uuid.UUID{tab.Id}, nil, &nested.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	export := exportStore(t, s)
+
+	// replacing brings the collections back
+	report := importStore(t, s, export, ImportOptions{Mode: ImportReplace})
+	if report.Manifest.Collections != 2 || report.Collections != 2 {
+		t.Errorf("%d collections in the manifest and %d imported, want 2", report.Manifest.Collections, report.Collections)
+	}
+	page, err := s.GetCollectionTabsPage(nested.Id, true, Page{})
+	if err != nil || len(page.Tabs) != 1 || page.Tabs[0].Id != tab.Id {
+		t.Errorf("tabs in the collection after replacing: %+v, %v", page.Tabs, err)
+	}
+	if _, shared, err := s.GetCollections("bob"); err != nil || len(shared) != 1 || shared[0].Id != songs.Id {
+		t.Errorf("collections shared with bob after replacing: %+v, %v", shared, err)
+	}
+
+	// renamed users keep their collections
+	other := newTestStore(t, "alice")
+	importStore(t, other, export, ImportOptions{Mode: ImportMerge})
+	own, _, err := other.GetCollections("alice-2")
+	if err != nil || len(own) != 2 {
+		t.Fatalf("collections of the renamed user: %+v, %v", own, err)
+	}
+	if c, err := other.GetCollection(nested.Id); err != nil || c.Parent == nil || *c.Parent != songs.Id {
+		t.Errorf("nested collection after renaming: %+v, %v", c, err)
+	}
+
+	// tabs are kept out of collections that were skipped
+	other = newTestStore(t, "carol")
+	err = other.db.Update(func(txn Txn) error {
+		return putCollection(txn, &Collection{Id: nested.Id, Owner: "carol", Name: "mine"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = importStore(t, other, export, ImportOptions{Mode: ImportMerge})
+	if len(report.SkippedCollections) != 1 || report.SkippedCollections[0] != nested.Id {
+		t.Errorf("skipped collections %v, want %v", report.SkippedCollections, nested.Id)
+	}
+	if res, err := other.GetTab(tab.Id); err != nil || len(res.Collections) != 0 {
+		t.Errorf("tab after skipping its collection: %+v, %v", res, err)
+	}
+	page, err = other.GetCollectionTabsPage(nested.Id, true, Page{})
+	if err != nil || len(page.Tabs) != 0 {
+		t.Errorf("tabs in the collection of another user: %+v, %v", page.Tabs, err)
+	}
+}
+
+func TestExportStars(t *testing.T) {
+	s := newTestStore(t, "alice", "bob")
+	first := newTestTab(t, s, "alice")
+	second := newTestTab(t, s, "alice")
+	for _, tab := range []*Tab{first, second} {
+		tab.Public = true
+		if err := s.SetTab(tab.Id, tab); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.StarTab(tab.Id, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.StarTab(first.Id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	export := exportStore(t, s)
+
+	other := newTestStore(t, "bob")
+	report := importStore(t, other, export, ImportOptions{Mode: ImportMerge})
+	if report.Manifest.Stars != 3 || report.Stars != 3 {
+		t.Errorf("%d stars in the manifest and %d imported, want 3", report.Manifest.Stars, report.Stars)
+	}
+
+	// the favorites of the renamed user keep their order
+	page, err := other.GetFavoritesPage("bob-2", Page{})
+	if err != nil || len(page.Tabs) != 2 || page.Tabs[0].Id != first.Id || page.Tabs[1].Id != second.Id {
+		t.Errorf("favorites of the renamed user: %+v, %v", page.Tabs, err)
+	}
+	if page, err := other.GetFavoritesPage("bob", Page{}); err != nil || len(page.Tabs) != 0 {
+		t.Errorf("favorites of the existing user: %+v, %v", page.Tabs, err)
+	}
+	if tabs, err := other.WithStars([]Tab{*first}); err != nil || tabs[0].Stars != 2 {
+		t.Errorf("stars of a tab: %+v, %v", tabs, err)
+	}
+
+	// stars are not imported twice
+	report = importStore(t, s, export, ImportOptions{Mode: ImportMerge, OnCollision: CollisionSkip})
+	if report.Stars != 0 {
+		t.Errorf("imported %d stars again", report.Stars)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+// The fork index lists the forks of a tab: idx_fork_<source>_<fork>.
+// Trashed forks leave the index like they leave every other listing.
+const forkIndexPrefix = indexPrefix + "fork_"
+
+func forkIndexPrefixFor(source uuid.UUID) []byte {
+	return prefix(forkIndexPrefix, source.String()+"_")
+}
+
+func forkIndexKey(source uuid.UUID, id uuid.UUID) []byte {
+	return append(forkIndexPrefixFor(source), id.String()...)
+}
+
+// rewriteContentsId points the id inside the tab JSON at another tab, so
+// the editor saves a copy to the copy and not to the original.
+func rewriteContentsId(contents string, id uuid.UUID) (string, error) {
+	if strings.TrimSpace(contents) == "" {
+		return contents, nil
+	}
+
+	var tab map[string]interface{}
+	if err := json.Unmarshal([]byte(contents), &tab); err != nil {
+		return "", fmt.Errorf("contents: %v", err)
+	}
+
+	tab["id"] = id.String()
+	res, err := json.Marshal(tab)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// latestRevision returns the id of the newest revision of a tab, or "" for
+// tabs which were never saved.
+func latestRevision(txn Txn, id uuid.UUID) (string, error) {
+	res := ""
+	p := revisionTabPrefix(id)
+	err := txn.IterateKeys(p, func(key []byte) error {
+		if id := string(key[len(p):]); id > res {
+			res = id
+		}
+		return nil
+	})
+	return res, err
+}
+
+// ForkTab copies a tab into the account of owner. The copy remembers which
+// tab and revision it was made from. Like CreateTab, it fails with
+// ErrTabQuota or ErrByteQuota when the owner has no room for it.
+func (s Store) ForkTab(source uuid.UUID, owner string) (*Tab, error) {
+	var res *Tab
+	err := s.db.Update(func(txn Txn) error {
+		var src Tab
+		err := getJSON(txn, prefix(tabPrefix, source.String()), &src)
+		if err != nil {
+			return err
+		}
+
+		revision, err := latestRevision(txn, source)
+		if err != nil {
+			return err
+		}
+
+		id := uuid.New()
+		contents, err := rewriteContentsId(src.Contents, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		tab := Tab{
+			Id:             id,
+			Owner:          owner,
+			Public:         false,
+			Contents:       contents,
+			CreatedAt:      now,
+			ForkedFrom:     &source,
+			ForkedRevision: revision,
+		}
+		touchTab(&tab, owner, now)
+
+		err = addTabToUser(txn, owner, tab.Id, tab.ContentSize)
+		if err != nil {
+			return err
+		}
+
+		err = s.checkQuota(txn, owner)
+		if err != nil {
+			return err
+		}
+
+		res = &tab
+		return putTab(txn, &tab)
+	})
+	return res, err
+}
+
+// GetForks lists the tabs forked from a tab, oldest first, including the
+// forks which are not public.
+func (s Store) GetForks(source uuid.UUID) ([]Tab, error) {
+	res := []Tab{}
+	err := s.db.View(func(txn Txn) error {
+		tabs, err := indexedTabs(txn, forkIndexPrefixFor(source), false)
+		res = append(res, tabs...)
+		return err
+	})
+	_ = sortTabs(res, SortCreated, false)
+	return res, err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/jonay2000/ainulindale/server/pkg/tabdata"
+	"log"
+	"net/http"
+)
+
+// tabContents decodes the contents of a tab. Tabs which were never saved
+// have the contents the editor starts them with.
+func tabContents(tab *Tab) (*tabdata.TabData, error) {
+	if tab.Contents == "" {
+		return tabdata.Default(tab.Id.String()), nil
+	}
+	return tabdata.Decode([]byte(tab.Contents))
+}
+
+// Formats a tab can be imported from. Guitar Pro 3, 4 and 5 files are told
+// apart by their header.
+const (
+	FormatASCII     = "ascii"
+	FormatGuitarPro = "gp"
+)
+
+var ErrUnknownFormat = errors.New("unknown import format")
+var ErrNotBase64 = errors.New("binary formats must be base64 encoded")
+
+// ImportedTab is a tab created from an import, with what could not be
+// imported.
+type ImportedTab struct {
+	Tab      Tab
+	Warnings []tabdata.Warning
+}
+
+// importTab reads the contents of a new tab from data in format, which
+// defaults to FormatASCII. Binary formats are base64 encoded, and track
+// picks the track of formats which have several, counting from 1.
+func importTab(format string, data string, track int) (*tabdata.TabData, []tabdata.Warning, error) {
+	switch format {
+	case "", FormatASCII:
+		return tabdata.ParseASCII(data)
+	case FormatGuitarPro:
+		file, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, nil, ErrNotBase64
+		}
+		return tabdata.ParseGuitarPro(file, track)
+	}
+	return nil, nil, ErrUnknownFormat
+}
+
+// writeImportError answers a request with a file which can't be imported,
+// and reports whether err was such an error. An imported tab which doesn't
+// validate is answered with its problems.
+func writeImportError(w http.ResponseWriter, err error) bool {
+	if errs, ok := err.(tabdata.Errors); ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(errs.Error()))
+		return true
+	}
+
+	switch err {
+	case ErrUnknownFormat, ErrNotBase64, tabdata.ErrNoTablature, tabdata.ErrNotGuitarPro, tabdata.ErrDamagedGuitarPro, tabdata.ErrUnknownTrack:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		return false
+	}
+
+	_, _ = w.Write([]byte(err.Error()))
+	return true
+}
+
+// exportTab loads the tab of an export request, which is visible by the
+// same rules as /tab/get. The token of the owner is taken from the request,
+// see requestToken. When the tab can't be exported, the request has been
+// answered.
+func exportTab(w http.ResponseWriter, r *http.Request, tabStore TabStore, lm *LoginManager) (*Tab, *tabdata.TabData, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	tab, err := tabStore.GetTab(id)
+	if err != nil {
+		log.Printf("%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if tab == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	if !tab.Public || tab.TrashedAt != nil {
+		user, err := lm.DecodeToken(requestToken(r))
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return nil, nil, false
+		}
+
+		if user.Name != tab.Owner {
+			w.WriteHeader(http.StatusUnauthorized)
+			return nil, nil, false
+		}
+	}
+
+	data, err := tabContents(tab)
+	if err != nil {
+		log.Printf("tab %s: %v", tab.Id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return tab, data, true
+}
+
+// exportDisposition downloads an export as a file named after the tab id,
+// as names can hold anything.
+func exportDisposition(tab *Tab, extension string) string {
+	return fmt.Sprintf("attachment; filename=\"%s.%s\"", tab.Id, extension)
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+)
+
+const (
+	// a user lists a tab which does not exist, or belongs to someone else
+	FsckDanglingTab = "dangling"
+	// a tab whose owner does not exist, or does not list it
+	FsckOrphanedTab = "orphaned"
+	// a user lists the same tab more than once
+	FsckDuplicateTab = "duplicate"
+	// a record that can't be decoded, or is stored under the wrong key
+	FsckUndecodable = "undecodable"
+	// the usage stored with a user does not match their tabs
+	FsckUsage = "usage"
+)
+
+type FsckProblem struct {
+	Kind     string
+	Key      string
+	Detail   string
+	Repaired bool
+}
+
+func (p FsckProblem) String() string {
+	res := fmt.Sprintf("%s %s: %s", p.Kind, p.Key, p.Detail)
+	if p.Repaired {
+		res += " (repaired)"
+	}
+	return res
+}
+
+type FsckReport struct {
+	Users    int
+	Tabs     int
+	Problems []FsckProblem
+}
+
+func (r FsckReport) String() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "checked %d users and %d tabs, found %d problems", r.Users, r.Tabs, len(r.Problems))
+	for _, p := range r.Problems {
+		_, _ = fmt.Fprintf(&b, "\n  %s", p)
+	}
+	return b.String()
+}
+
+// Fsck checks that users and tabs agree about who owns what and that every
+// record can be read. With repair set, problems are fixed as follows:
+// dangling and duplicate ids are removed from the user, orphaned tabs are
+// added to their owner or deleted when the owner is gone, undecodable
+// records are deleted and wrong usage is counted again.
+func (s Store) Fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	users := map[string]User{}
+	tabs := map[uuid.UUID]Tab{}
+
+	err := s.db.View(func(txn Txn) error {
+		err := txn.Iterate([]byte(userPrefix), false, func(key []byte, val []byte) error {
+			var user User
+			err := decodeJSON(key, val, &user)
+			if err == nil && !bytes.Equal(key, prefix(userPrefix, user.Name)) {
+				err = fmt.Errorf("holds user %s", user.Name)
+			}
+			if err != nil {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckUndecodable,
+					Key:    string(key),
+					Detail: err.Error(),
+				})
+				return nil
+			}
+
+			users[user.Name] = user
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Iterate([]byte(tabPrefix), false, func(key []byte, val []byte) error {
+			var tab Tab
+			err := decodeJSON(key, val, &tab)
+			if err == nil && !bytes.Equal(key, prefix(tabPrefix, tab.Id.String())) {
+				err = fmt.Errorf("holds tab %s", tab.Id)
+			}
+			if err != nil {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckUndecodable,
+					Key:    string(key),
+					Detail: err.Error(),
+				})
+				return nil
+			}
+
+			tab.Contents = ""
+			tabs[tab.Id] = tab
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return txn.Iterate([]byte(revisionPrefix), false, func(key []byte, val []byte) error {
+			var rev Revision
+			err := decodeJSON(key, val, &rev)
+			if err == nil && !bytes.Equal(key, revisionKey(rev.Tab, rev.Id)) {
+				err = fmt.Errorf("holds revision %s of %s", rev.Id, rev.Tab)
+			}
+			if err != nil {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckUndecodable,
+					Key:    string(key),
+					Detail: err.Error(),
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Users = len(users)
+	report.Tabs = len(tabs)
+
+	listed := map[uuid.UUID]bool{}
+	for _, user := range users {
+		if user.Usage != nil {
+			var usage Usage
+			for _, id := range user.Tabs {
+				if tab, ok := tabs[id]; ok {
+					usage.Tabs += 1
+					usage.Bytes += tab.ContentSize
+				}
+			}
+			if usage != *user.Usage {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckUsage,
+					Key:    string(prefix(userPrefix, user.Name)),
+					Detail: fmt.Sprintf("stores usage %+v, but has %+v", *user.Usage, usage),
+				})
+			}
+		}
+
+		seen := map[uuid.UUID]bool{}
+		for _, id := range user.Tabs {
+			key := string(prefix(userPrefix, user.Name))
+			if seen[id] {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckDuplicateTab,
+					Key:    key,
+					Detail: fmt.Sprintf("lists tab %s more than once", id),
+				})
+				continue
+			}
+			seen[id] = true
+
+			tab, ok := tabs[id]
+			if !ok {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckDanglingTab,
+					Key:    key,
+					Detail: fmt.Sprintf("lists tab %s which does not exist", id),
+				})
+				continue
+			}
+
+			if tab.Owner != user.Name {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckDanglingTab,
+					Key:    key,
+					Detail: fmt.Sprintf("lists tab %s which belongs to %s", id, tab.Owner),
+				})
+				continue
+			}
+			listed[id] = true
+		}
+	}
+
+	for id, tab := range tabs {
+		if listed[id] {
+			continue
+		}
+
+		_, ownerExists := users[tab.Owner]
+		if !ownerExists && tab.TrashedAt != nil {
+			// the tabs of deleted users wait in the trash to be purged
+			continue
+		}
+
+		detail := fmt.Sprintf("owner %s does not exist", tab.Owner)
+		if ownerExists {
+			detail = fmt.Sprintf("owner %s does not list it", tab.Owner)
+		}
+		report.Problems = append(report.Problems, FsckProblem{
+			Kind:   FsckOrphanedTab,
+			Key:    string(prefix(tabPrefix, id.String())),
+			Detail: detail,
+		})
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	for i := range report.Problems {
+		err := s.db.Update(func(txn Txn) error {
+			return repairProblem(txn, &report.Problems[i], tabs)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// repairProblem re-reads the records involved in the problem, so fixing one
+// problem doesn't undo the fix of an earlier one on the same user.
+func repairProblem(txn Txn, problem *FsckProblem, tabs map[uuid.UUID]Tab) error {
+	key := []byte(problem.Key)
+
+	switch problem.Kind {
+	case FsckUndecodable:
+		if bytes.HasPrefix(key, []byte(tabPrefix)) {
+			id, err := uuid.Parse(problem.Key[len(tabPrefix):])
+			if err == nil {
+				if err := rmTabIndexes(txn, id); err != nil {
+					return err
+				}
+			}
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+
+	case FsckDanglingTab, FsckDuplicateTab:
+		var user User
+		if err := getJSON(txn, key, &user); err != nil {
+			return err
+		}
+
+		seen := map[uuid.UUID]bool{}
+		res := make([]uuid.UUID, 0, len(user.Tabs))
+		for _, id := range user.Tabs {
+			if tab, ok := tabs[id]; ok && tab.Owner == user.Name && !seen[id] {
+				res = append(res, id)
+			}
+			seen[id] = true
+		}
+		user.Tabs = res
+		user.Usage = nil
+
+		if err := setJSON(txn, key, &user); err != nil {
+			return err
+		}
+
+	case FsckUsage:
+		var user User
+		if err := getJSON(txn, key, &user); err != nil {
+			return err
+		}
+
+		// counted again the next time it is needed
+		user.Usage = nil
+		if err := setJSON(txn, key, &user); err != nil {
+			return err
+		}
+
+	case FsckOrphanedTab:
+		id, err := uuid.Parse(problem.Key[len(tabPrefix):])
+		if err != nil {
+			return err
+		}
+
+		err = addTabToUser(txn, tabs[id].Owner, id, tabs[id].ContentSize)
+		if err == ErrNotFound {
+			err = deleteTab(txn, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	problem.Repaired = true
+	return nil
+}
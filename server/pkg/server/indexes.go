@@ -0,0 +1,307 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Secondary indexes are keys without a value, which are kept up to date in the
+// same transaction as the tab they point to. Every tab has a ref record listing
+// the index keys currently pointing at it, so they can be removed again
+// without knowing what the tab looked like when they were written.
+const indexPrefix = "idx_"
+const sortIndexPrefix = indexPrefix + "sort_"
+const ownerIndexPrefix = indexPrefix + "own_"
+const indexRefPrefix = indexPrefix + "ref_"
+const trashIndexPrefix = indexPrefix + "trash_"
+const purgeIndexPrefix = indexPrefix + "purge_"
+
+// bump indexVersion whenever tabIndexKeys changes, the indexes are
+// then rebuilt the next time the server starts.
+const indexVersionKey = "meta_index_version"
+const indexVersion = 9
+
+// indexTime formats a time so that it sorts correctly as bytes.
+func indexTime(t time.Time) string {
+	var nanos int64
+	if !t.IsZero() {
+		nanos = t.UnixNano()
+	}
+	return fmt.Sprintf("%020d", nanos)
+}
+
+func timeIndexKey(p string, t time.Time, id uuid.UUID) []byte {
+	return prefix(p, indexTime(t)+"_"+id.String())
+}
+
+// purgeIndexKey sorts trashed tabs by when they were trashed.
+func purgeIndexKey(trashed time.Time, id uuid.UUID) []byte {
+	return timeIndexKey(purgeIndexPrefix, trashed, id)
+}
+
+// ownerIndexPrefixFor separates the owner from the id with a zero byte,
+// which /register does not allow in usernames.
+func ownerIndexPrefixFor(owner string) []byte {
+	return prefix(ownerIndexPrefix, owner+"\x00")
+}
+
+func ownerIndexKey(owner string, id uuid.UUID) []byte {
+	return append(ownerIndexPrefixFor(owner), id.String()...)
+}
+
+func trashIndexPrefixFor(owner string) []byte {
+	return prefix(trashIndexPrefix, owner+"\x00")
+}
+
+// Sort indexes list the tabs in a scope, all public tabs or the tabs of one
+// owner, in one of the Sort orders: idx_sort_<scope>\x00<order>\x00<value>\x00<id>.
+// Values are formatted so that they sort the same way as bytes.
+const publicScope = "pub"
+
+func ownerScope(owner string) string {
+	return "own_" + owner
+}
+
+func sortIndexPrefixFor(scope string, order string) []byte {
+	return prefix(sortIndexPrefix, scope+"\x00"+order+"\x00")
+}
+
+func sortIndexKeys(scope string, tab *Tab, updated time.Time) [][]byte {
+	values := map[string]string{
+		SortCreated: indexTime(tab.CreatedAt),
+		SortUpdated: indexTime(updated),
+		SortEditor:  tab.LastEditedBy,
+		SortSize:    fmt.Sprintf("%020d", tab.ContentSize),
+	}
+
+	var keys [][]byte
+	for _, order := range sortOrders {
+		key := sortIndexPrefixFor(scope, order)
+		key = append(key, values[order]+"\x00"+tab.Id.String()...)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func indexRefKey(id uuid.UUID) []byte {
+	return prefix(indexRefPrefix, id.String())
+}
+
+// indexedTabId extracts the tab id every index key ends with.
+func indexedTabId(key []byte) (uuid.UUID, error) {
+	if len(key) < 36 {
+		return uuid.UUID{}, fmt.Errorf("invalid index key %q", key)
+	}
+	return uuid.Parse(string(key[len(key)-36:]))
+}
+
+func tabIndexKeys(txn Txn, tab *Tab, updated time.Time) [][]byte {
+	// trashed tabs only show up in the trash
+	if tab.TrashedAt != nil {
+		return [][]byte{
+			append(trashIndexPrefixFor(tab.Owner), tab.Id.String()...),
+			purgeIndexKey(*tab.TrashedAt, tab.Id),
+		}
+	}
+
+	keys := [][]byte{
+		ownerIndexKey(tab.Owner, tab.Id),
+	}
+	keys = append(keys, sortIndexKeys(ownerScope(tab.Owner), tab, updated)...)
+	if tab.Public {
+		keys = append(keys, sortIndexKeys(publicScope, tab, updated)...)
+	}
+	if tab.ForkedFrom != nil {
+		keys = append(keys, forkIndexKey(*tab.ForkedFrom, tab.Id))
+	}
+	keys = append(keys, collectionTabIndexKeys(tab, updated)...)
+	keys = append(keys, tagIndexKeys(txn, tab, updated)...)
+	return append(keys, tabSearchKeys(txn, tab)...)
+}
+
+func setTabIndexes(txn Txn, tab *Tab, updated time.Time) error {
+	return setIndexes(txn, tab.Id, tabIndexKeys(txn, tab, updated))
+}
+
+// setIndexes replaces the index keys pointing at a tab or collection.
+func setIndexes(txn Txn, id uuid.UUID, keys [][]byte) error {
+	if err := rmTabIndexes(txn, id); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := txn.Set(key, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return setJSON(txn, indexRefKey(id), keys)
+}
+
+// rmTabIndexes removes the index keys pointing at a tab, or a collection.
+func rmTabIndexes(txn Txn, id uuid.UUID) error {
+	var keys [][]byte
+	err := getJSON(txn, indexRefKey(id), &keys)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return txn.Delete(indexRefKey(id))
+}
+
+// indexedTabs looks up the tabs an index points to, in index order.
+func indexedTabs(txn Txn, p []byte, reverse bool) ([]Tab, error) {
+	var ids []uuid.UUID
+	err := txn.Iterate(p, reverse, func(key []byte, _ []byte) error {
+		id, err := indexedTabId(key)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Tab
+	for _, id := range ids {
+		var tab Tab
+		err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tab)
+	}
+
+	return res, nil
+}
+
+// lastUpdated guesses when a tab was last changed from its newest revision.
+func lastUpdated(txn Txn, id uuid.UUID) (time.Time, error) {
+	var res time.Time
+	p := revisionTabPrefix(id)
+	err := txn.IterateKeys(p, func(key []byte) error {
+		t, err := revisionTime(string(key[len(p):]))
+		if err == nil && t.After(res) {
+			res = t
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s Store) IndexesUpToDate() (bool, error) {
+	var version int
+	err := s.db.View(func(txn Txn) error {
+		err := getJSON(txn, []byte(indexVersionKey), &version)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	return version == indexVersion, err
+}
+
+// RebuildIndexes throws away all secondary indexes and regenerates them from
+// the tabs themselves. It returns the number of indexed tabs.
+func (s Store) RebuildIndexes() (int, error) {
+	var keys [][]byte
+	err := s.db.View(func(txn Txn) error {
+		return txn.IterateKeys([]byte(indexPrefix), func(key []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = batchUpdate(s.db, keys, deleteBatchSize, deleteKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []uuid.UUID
+	err = s.db.View(func(txn Txn) error {
+		return txn.IterateKeys([]byte(tabPrefix), func(key []byte) error {
+			id, err := uuid.Parse(string(key[len(tabPrefix):]))
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		err := s.db.Update(func(txn Txn) error {
+			var tab Tab
+			err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+			if err == ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// tabs from before UpdatedAt existed
+			updated := tab.UpdatedAt
+			if updated.IsZero() {
+				updated, err = lastUpdated(txn, id)
+				if err != nil {
+					return err
+				}
+			}
+
+			return setTabIndexes(txn, &tab, updated)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var collections []Collection
+	err = s.db.View(func(txn Txn) error {
+		return txn.Iterate([]byte(collectionPrefix), false, func(key []byte, val []byte) error {
+			var c Collection
+			if err := decodeJSON(key, val, &c); err != nil {
+				return err
+			}
+			collections = append(collections, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range collections {
+		err := s.db.Update(func(txn Txn) error {
+			return setIndexes(txn, collections[i].Id, collectionIndexKeys(&collections[i]))
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), s.db.Update(func(txn Txn) error {
+		return setJSON(txn, []byte(indexVersionKey), indexVersion)
+	})
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+var ErrInvalidSort = errors.New("invalid sort order")
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const DefaultPageSize = 50
+const MaxPageSize = 500
+
+// Orders the tab listings can be sorted in, as sent by clients.
+const (
+	SortCreated = "created"
+	SortUpdated = "updated"
+	SortEditor  = "editor"
+	SortSize    = "size"
+	// users can only be sorted by name
+	SortName = "name"
+)
+
+var sortOrders = []string{SortCreated, SortUpdated, SortEditor, SortSize}
+
+func validTabSort(order string) bool {
+	for _, o := range sortOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// sortTabs sorts tabs in place by one of the Sort orders. An empty order
+// leaves the tabs as they are. Ties are broken by id, so the order is stable.
+func sortTabs(tabs []Tab, order string, desc bool) error {
+	var less func(a, b *Tab) bool
+	switch order {
+	case "":
+		return nil
+	case SortCreated:
+		less = func(a, b *Tab) bool { return a.CreatedAt.Before(b.CreatedAt) }
+	case SortUpdated:
+		less = func(a, b *Tab) bool { return a.UpdatedAt.Before(b.UpdatedAt) }
+	case SortEditor:
+		less = func(a, b *Tab) bool { return a.LastEditedBy < b.LastEditedBy }
+	case SortSize:
+		less = func(a, b *Tab) bool { return a.ContentSize < b.ContentSize }
+	default:
+		return ErrInvalidSort
+	}
+
+	sort.SliceStable(tabs, func(i, j int) bool {
+		a, b := &tabs[i], &tabs[j]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Id.String() < b.Id.String()
+	})
+	return nil
+}
+
+// Page selects part of a listing. Cursors are opaque to clients, they are
+// the Next cursor of the previous page.
+type Page struct {
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// Paginated tells whether a page was asked for at all. Listings without a
+// limit or cursor return everything, as they always have.
+func (p Page) Paginated() bool {
+	return p.Limit > 0 || p.Cursor != ""
+}
+
+type TabPage struct {
+	Tabs []Tab
+	// Next is the cursor of the next page, empty on the last page.
+	Next  string
+	Total int
+}
+
+type UserPage struct {
+	Users []User
+	Next  string
+	Total int
+}
+
+// pageEntries reads a page of the keys starting with p, seeking to the key
+// in the cursor instead of reading everything before it.
+func pageEntries(txn Txn, p []byte, page Page) (keys [][]byte, values [][]byte, next string, total int, err error) {
+	limit := page.Limit
+	if page.Paginated() && limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	var start []byte
+	if page.Cursor != "" {
+		suffix, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+		if err != nil || len(suffix) == 0 {
+			return nil, nil, "", 0, ErrInvalidCursor
+		}
+		start = append(append([]byte{}, p...), suffix...)
+	}
+
+	more := false
+	err = txn.IterateAfter(p, start, page.Desc, func(key []byte, value []byte) error {
+		if limit > 0 && len(keys) == limit {
+			more = true
+			return errStopIteration
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, nil, "", 0, err
+	}
+
+	if more {
+		next = base64.RawURLEncoding.EncodeToString(keys[len(keys)-1][len(p):])
+	}
+
+	err = txn.IterateKeys(p, func(_ []byte) error {
+		total += 1
+		return nil
+	})
+	return keys, values, next, total, err
+}
+
+func (s Store) tabPage(p []byte, page Page) (TabPage, error) {
+	res := TabPage{Tabs: []Tab{}}
+	err := s.db.View(func(txn Txn) error {
+		keys, _, next, total, err := pageEntries(txn, p, page)
+		if err != nil {
+			return err
+		}
+		res.Next, res.Total = next, total
+
+		for _, key := range keys {
+			id, err := indexedTabId(key)
+			if err != nil {
+				return err
+			}
+
+			var tab Tab
+			err = getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			res.Tabs = append(res.Tabs, tab)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// GetUserTabsPage lists the tabs of a user. Without a sort order they are
+// listed by id.
+func (s Store) GetUserTabsPage(owner string, page Page) (TabPage, error) {
+	if page.Sort == "" {
+		return s.tabPage(ownerIndexPrefixFor(owner), page)
+	}
+	if !validTabSort(page.Sort) {
+		return TabPage{}, ErrInvalidSort
+	}
+	return s.tabPage(sortIndexPrefixFor(ownerScope(owner), page.Sort), page)
+}
+
+// GetPublicTabsPage lists the public tabs, by default the most recently
+// updated first.
+func (s Store) GetPublicTabsPage(page Page) (TabPage, error) {
+	if page.Sort == "" {
+		page.Sort, page.Desc = SortUpdated, true
+	}
+	if !validTabSort(page.Sort) {
+		return TabPage{}, ErrInvalidSort
+	}
+	return s.tabPage(sortIndexPrefixFor(publicScope, page.Sort), page)
+}
+
+// GetUsersPage lists users by name.
+func (s Store) GetUsersPage(page Page) (UserPage, error) {
+	if page.Sort != "" && page.Sort != SortName {
+		return UserPage{}, ErrInvalidSort
+	}
+
+	res := UserPage{Users: []User{}}
+	err := s.db.View(func(txn Txn) error {
+		keys, values, next, total, err := pageEntries(txn, []byte(userPrefix), page)
+		if err != nil {
+			return err
+		}
+		res.Next, res.Total = next, total
+
+		for i := range keys {
+			var user User
+			if err := decodeJSON(keys[i], values[i], &user); err != nil {
+				return err
+			}
+			res.Users = append(res.Users, user)
+		}
+		return nil
+	})
+	return res, err
+}
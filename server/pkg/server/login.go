@@ -2,11 +2,12 @@ package server
 
 import (
 	"crypto"
-	"github.com/dgraph-io/badger"
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ed25519"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -35,10 +36,10 @@ type Claims struct {
 }
 
 type LoginManager struct {
-	store *Store
+	store UserStore
 }
 
-func NewLoginManager(store *Store) (*LoginManager, error) {
+func NewLoginManager(store UserStore) (*LoginManager, error) {
 	count, err := store.CountUsers()
 	if err != nil {
 		return nil, err
@@ -86,7 +87,7 @@ func (lm LoginManager) LogIn(lu User) (SessionUser, error) {
 
 func (lm LoginManager) CreateUser(user User) (bool, error) {
 	_, err := lm.store.GetUser(user.Name)
-	if err != nil && err != badger.ErrKeyNotFound {
+	if err != nil && err != ErrNotFound {
 		return false, err
 	} else if err == nil {
 		return true, nil
@@ -127,6 +128,16 @@ func (lm LoginManager) DecodeToken(token string) (User, error) {
 	return lm.store.GetUser(claims.User.Name)
 }
 
+// requestToken gets the token of a GET request, which has no body to put it
+// in, from the Authorization header. It is never taken from the URL, which
+// ends up in the request log.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
 
 func NewTokenUser(user SessionUser) (*TokenUser, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, Claims{
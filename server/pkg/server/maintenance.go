@@ -0,0 +1,218 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaintenancePolicy decides when garbage is collected: every Interval, and
+// whenever the store has grown by SizeThreshold bytes since the last run.
+type MaintenancePolicy struct {
+	Interval      time.Duration
+	SizeThreshold int
+}
+
+var DefaultMaintenancePolicy = MaintenancePolicy{
+	Interval:      6 * time.Hour,
+	SizeThreshold: 256 << 20,
+}
+
+// how often the size of the store is compared against the threshold
+const sizeCheckInterval = time.Minute
+
+func maintenancePolicy() MaintenancePolicy {
+	res := DefaultMaintenancePolicy
+	res.SizeThreshold = envInt("MAINTENANCE_SIZE_THRESHOLD", res.SizeThreshold)
+
+	if env := os.Getenv("MAINTENANCE_INTERVAL"); env != "" {
+		interval, err := time.ParseDuration(env)
+		if err != nil || interval <= 0 {
+			log.Printf("invalid value %q for MAINTENANCE_INTERVAL, using %v", env, res.Interval)
+		} else {
+			res.Interval = interval
+		}
+	}
+
+	return res
+}
+
+// maintainedBackend is implemented by backends which collect their own
+// garbage, so far only badger.
+type maintainedBackend interface {
+	CollectGarbage() error
+	DiskSize() (int64, error)
+}
+
+type MaintenanceStatus struct {
+	// false for backends which need no maintenance
+	Supported bool
+	Running   bool
+	Runs      int
+	// what started the last run: "schedule", "size" or "manual"
+	LastTrigger   string
+	LastRun       time.Time
+	LastDuration  time.Duration
+	LastError     string
+	LastReclaimed int64
+	// bytes reclaimed since the store was opened
+	TotalReclaimed int64
+	Size           int64
+}
+
+type maintenance struct {
+	backend maintainedBackend
+	policy  MaintenancePolicy
+
+	mu     sync.Mutex
+	status MaintenanceStatus
+	// size after the last run, growth is measured from here
+	baseSize int64
+
+	manual   chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// startMaintenance collects garbage in the background for backends that
+// need it. It is stopped by stop.
+func startMaintenance(db Backend, policy MaintenancePolicy) *maintenance {
+	m := &maintenance{
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	backend, ok := unwrapBackend(db).(maintainedBackend)
+	if !ok {
+		return m
+	}
+	m.backend = backend
+	m.status.Supported = true
+	m.manual = make(chan chan struct{})
+	m.stopped = make(chan struct{})
+
+	size, err := backend.DiskSize()
+	if err != nil {
+		log.Printf("maintenance: %v", err)
+	}
+	m.baseSize = size
+	m.status.Size = size
+
+	go m.loop()
+	return m
+}
+
+func (m *maintenance) loop() {
+	defer close(m.stopped)
+
+	schedule := time.NewTicker(m.policy.Interval)
+	defer schedule.Stop()
+	check := time.NewTicker(sizeCheckInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-schedule.C:
+			m.run("schedule")
+		case <-check.C:
+			if m.policy.SizeThreshold <= 0 {
+				continue
+			}
+			size, err := m.backend.DiskSize()
+			if err != nil {
+				log.Printf("maintenance: %v", err)
+				continue
+			}
+			m.mu.Lock()
+			grown := size - m.baseSize
+			m.mu.Unlock()
+			if grown >= int64(m.policy.SizeThreshold) {
+				m.run("size")
+			}
+		case reply := <-m.manual:
+			m.run("manual")
+			close(reply)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *maintenance) run(trigger string) {
+	m.mu.Lock()
+	m.status.Running = true
+	m.mu.Unlock()
+
+	start := time.Now()
+	before, err := m.backend.DiskSize()
+	if err == nil {
+		err = m.backend.CollectGarbage()
+	}
+	after, sizeErr := m.backend.DiskSize()
+	if err == nil {
+		err = sizeErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.Running = false
+	m.status.Runs += 1
+	m.status.LastTrigger = trigger
+	m.status.LastRun = start
+	m.status.LastDuration = time.Since(start)
+	m.status.LastError = ""
+	m.status.LastReclaimed = 0
+	if err != nil {
+		m.status.LastError = err.Error()
+		log.Printf("maintenance: %v", err)
+	} else if before > after {
+		m.status.LastReclaimed = before - after
+		m.status.TotalReclaimed += before - after
+	}
+	m.status.Size = after
+	m.baseSize = after
+}
+
+func (m *maintenance) getStatus() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// runNow runs maintenance and waits for it to finish.
+func (m *maintenance) runNow() {
+	if m.backend == nil {
+		return
+	}
+
+	reply := make(chan struct{})
+	select {
+	case m.manual <- reply:
+		<-reply
+	case <-m.done:
+	}
+}
+
+// stop ends the maintenance goroutine, waiting for a running GC to finish.
+func (m *maintenance) stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+		if m.stopped != nil {
+			<-m.stopped
+		}
+	})
+}
+
+// MaintenanceStatus reports on the last garbage collection.
+func (s Store) MaintenanceStatus() MaintenanceStatus {
+	return s.maintenance.getStatus()
+}
+
+// RunMaintenance collects garbage now instead of waiting for the schedule.
+func (s Store) RunMaintenance() MaintenanceStatus {
+	s.maintenance.runNow()
+	return s.maintenance.getStatus()
+}
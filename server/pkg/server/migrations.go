@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Migration upgrades one kind of record, identified by its key prefix,
+// from schema version From to From+1. Apply gets the decoded JSON record
+// and modifies it in place. The Schema field is set by the caller.
+type Migration struct {
+	Prefix      string
+	From        int
+	Description string
+	Apply       func(record map[string]interface{}) error
+}
+
+var migrations = map[string][]Migration{}
+
+// RegisterMigration adds a migration to the registry. Migrations of a prefix
+// have to be registered in order, starting from version 0.
+func RegisterMigration(m Migration) {
+	if len(migrations[m.Prefix]) != m.From {
+		panic(fmt.Sprintf("migration %s from %d registered out of order", m.Prefix, m.From))
+	}
+	migrations[m.Prefix] = append(migrations[m.Prefix], m)
+}
+
+// schemaVersion is the version records with this prefix are written with.
+func schemaVersion(prefix string) int {
+	return len(migrations[prefix])
+}
+
+// recordPrefix returns the registered prefix key belongs to, if any.
+func recordPrefix(key []byte) (string, bool) {
+	for p := range migrations {
+		if bytes.HasPrefix(key, []byte(p)) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func init() {
+	RegisterMigration(Migration{
+		Prefix:      userPrefix,
+		From:        0,
+		Description: "add schema version to users",
+		Apply:       func(record map[string]interface{}) error { return nil },
+	})
+	RegisterMigration(Migration{
+		Prefix:      tabPrefix,
+		From:        0,
+		Description: "default capo to 0 in tab contents",
+		Apply:       migrateContentsCapo,
+	})
+	RegisterMigration(Migration{
+		Prefix:      tabPrefix,
+		From:        1,
+		Description: "add content size to tabs",
+		Apply: func(record map[string]interface{}) error {
+			contents, _ := record["Contents"].(string)
+			record["ContentSize"] = len(contents)
+			return nil
+		},
+	})
+	RegisterMigration(Migration{
+		Prefix:      revisionPrefix,
+		From:        0,
+		Description: "default capo to 0 in revision contents",
+		Apply:       migrateContentsCapo,
+	})
+}
+
+// Tabs saved before the capo setting existed have no capo, which the editor
+// reads as undefined instead of "no capo".
+func migrateContentsCapo(record map[string]interface{}) error {
+	contents, _ := record["Contents"].(string)
+	if strings.TrimSpace(contents) == "" {
+		return nil
+	}
+
+	var tab map[string]interface{}
+	if err := json.Unmarshal([]byte(contents), &tab); err != nil {
+		// the editor can't open these either, leave them as they are
+		return nil
+	}
+	if _, ok := tab["capo"]; ok {
+		return nil
+	}
+
+	tab["capo"] = 0
+	res, err := json.Marshal(tab)
+	if err != nil {
+		return err
+	}
+	record["Contents"] = string(res)
+	return nil
+}
+
+func recordSchema(val []byte) (int, error) {
+	var header struct {
+		Schema int
+	}
+	err := json.Unmarshal(val, &header)
+	return header.Schema, err
+}
+
+// upgradeRecord runs all migrations needed to bring the record stored under
+// key up to the current schema. It returns the applied migrations,
+// or none when the record was already up to date.
+func upgradeRecord(key []byte, val []byte) ([]byte, []Migration, error) {
+	p, ok := recordPrefix(key)
+	if !ok {
+		return val, nil, nil
+	}
+
+	version, err := recordSchema(val)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	target := schemaVersion(p)
+	if version == target {
+		return val, nil, nil
+	}
+	if version > target {
+		return nil, nil, fmt.Errorf("%s has schema version %d, newer than the supported %d", key, version, target)
+	}
+
+	var record map[string]interface{}
+	d := json.NewDecoder(bytes.NewBuffer(val))
+	d.UseNumber()
+	if err := d.Decode(&record); err != nil {
+		return nil, nil, err
+	}
+
+	applied := migrations[p][version:]
+	for _, m := range applied {
+		if err := m.Apply(record); err != nil {
+			return nil, nil, fmt.Errorf("%s: migration %q: %v", key, m.Description, err)
+		}
+		record["Schema"] = m.From + 1
+	}
+
+	res, err := json.Marshal(record)
+	return res, applied, err
+}
+
+// decodeJSON decodes a stored record, upgrading it in memory first
+// when it was written with an older schema.
+func decodeJSON(key []byte, val []byte, v interface{}) error {
+	val, err := decompressValue(val)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+
+	val, _, err = upgradeRecord(key, val)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewBuffer(val)).Decode(v)
+}
+
+type MigrationCount struct {
+	Prefix      string
+	From        int
+	Description string
+	Records     int
+}
+
+type MigrationReport struct {
+	DryRun     bool
+	Migrations []MigrationCount
+	// keys of all records that were (or would be) upgraded
+	Upgraded []string
+}
+
+func (r MigrationReport) String() string {
+	if len(r.Upgraded) == 0 {
+		return "all records are up to date"
+	}
+
+	var b strings.Builder
+	verb := "upgraded"
+	if r.DryRun {
+		verb = "would upgrade"
+	}
+	_, _ = fmt.Fprintf(&b, "%s %d records", verb, len(r.Upgraded))
+	for _, m := range r.Migrations {
+		_, _ = fmt.Fprintf(&b, "\n  %s%d -> %d (%s): %d", m.Prefix, m.From, m.From+1, m.Description, m.Records)
+	}
+	return b.String()
+}
+
+// Migrate upgrades every stored record to the current schema. In dry run
+// mode nothing is written and the report says what would have changed.
+func (s Store) Migrate(dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{
+		DryRun: dryRun,
+	}
+	counts := map[string]int{}
+	countKey := func(m Migration) string {
+		return fmt.Sprintf("%s%d", m.Prefix, m.From)
+	}
+
+	var prefixes []string
+	for p := range migrations {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	for _, p := range prefixes {
+		var outdated [][]byte
+		err := s.db.View(func(txn Txn) error {
+			return txn.Iterate([]byte(p), false, func(key []byte, val []byte) error {
+				val, err := decompressValue(val)
+				if err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+
+				version, err := recordSchema(val)
+				if err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+				if version != schemaVersion(p) {
+					outdated = append(outdated, key)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range outdated {
+			upgrade := func(txn Txn) error {
+				val, err := txn.Get(key)
+				if err == ErrNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				val, err = decompressValue(val)
+				if err != nil {
+					return err
+				}
+
+				res, applied, err := upgradeRecord(key, val)
+				if err != nil {
+					return err
+				}
+				for _, m := range applied {
+					counts[countKey(m)] += 1
+				}
+				report.Upgraded = append(report.Upgraded, string(key))
+
+				if dryRun {
+					return nil
+				}
+				return txn.Set(key, compressValue(res))
+			}
+
+			if dryRun {
+				err = s.db.View(upgrade)
+			} else {
+				err = s.db.Update(upgrade)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, p := range prefixes {
+		for _, m := range migrations[p] {
+			if counts[countKey(m)] > 0 {
+				report.Migrations = append(report.Migrations, MigrationCount{
+					Prefix:      m.Prefix,
+					From:        m.From,
+					Description: m.Description,
+					Records:     counts[countKey(m)],
+				})
+			}
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+)
+
+var ErrTabQuota = errors.New("tab quota exceeded")
+var ErrByteQuota = errors.New("storage quota exceeded")
+
+// Quota limits what a user can store. Zero means no limit.
+type Quota struct {
+	MaxTabs  int
+	MaxBytes int
+}
+
+// Usage is what a user stores: the number of tabs they own and the size of
+// their contents. Tabs in the trash count until they are purged, old
+// revisions don't count.
+type Usage struct {
+	Tabs  int
+	Bytes int
+}
+
+var DefaultQuota = Quota{
+	MaxTabs:  1000,
+	MaxBytes: 50 << 20,
+}
+
+func defaultQuota() Quota {
+	return Quota{
+		MaxTabs:  envInt("QUOTA_MAX_TABS", DefaultQuota.MaxTabs),
+		MaxBytes: envInt("QUOTA_MAX_BYTES", DefaultQuota.MaxBytes),
+	}
+}
+
+type QuotaReport struct {
+	Name  string
+	Usage Usage
+	Quota Quota
+	// Override is set when an admin gave the user a quota of their own.
+	Override bool
+}
+
+func (q Quota) check(usage Usage) error {
+	if q.MaxTabs > 0 && usage.Tabs > q.MaxTabs {
+		return ErrTabQuota
+	}
+	if q.MaxBytes > 0 && usage.Bytes > q.MaxBytes {
+		return ErrByteQuota
+	}
+	return nil
+}
+
+// userUsage returns the usage of a user, counting it first for users stored
+// before usage was tracked.
+func userUsage(txn Txn, user *User) (Usage, error) {
+	if user.Usage != nil {
+		return *user.Usage, nil
+	}
+
+	var res Usage
+	for _, id := range user.Tabs {
+		var tab Tab
+		err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return Usage{}, err
+		}
+
+		res.Tabs += 1
+		res.Bytes += tab.ContentSize
+	}
+
+	return res, nil
+}
+
+// addUsage changes the usage of a user stored in the same transaction.
+func addUsage(txn Txn, user *User, tabs int, bytes int) error {
+	usage, err := userUsage(txn, user)
+	if err != nil {
+		return err
+	}
+
+	usage.Tabs += tabs
+	usage.Bytes += bytes
+	user.Usage = &usage
+	return nil
+}
+
+// checkQuota fails when the owner uses more than their quota. Call it after
+// a change which makes a user use more, so the transaction is rolled back.
+func (s Store) checkQuota(txn Txn, owner string) error {
+	var user User
+	err := getJSON(txn, prefix(userPrefix, owner), &user)
+	if err != nil {
+		return err
+	}
+
+	usage, err := userUsage(txn, &user)
+	if err != nil {
+		return err
+	}
+
+	return s.quotaFor(&user).check(usage)
+}
+
+func (s Store) quotaFor(user *User) Quota {
+	if user.Quota != nil {
+		return *user.Quota
+	}
+	return s.Quota
+}
+
+// resizeTab accounts for a change in the size of a stored tab, which has
+// to be called before the new version of the tab is written.
+func (s Store) resizeTab(txn Txn, tab *Tab) error {
+	var old Tab
+	err := getJSON(txn, prefix(tabPrefix, tab.Id.String()), &old)
+	if err != nil {
+		return err
+	}
+
+	grown := tab.ContentSize - old.ContentSize
+	if grown == 0 {
+		return nil
+	}
+
+	var user User
+	err = getJSON(txn, prefix(userPrefix, tab.Owner), &user)
+	if err == ErrNotFound {
+		// the tabs of deleted users in the trash
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := addUsage(txn, &user, 0, grown); err != nil {
+		return err
+	}
+	if err := setJSON(txn, prefix(userPrefix, user.Name), &user); err != nil {
+		return err
+	}
+
+	// always allow making a tab smaller
+	if grown < 0 {
+		return nil
+	}
+	return s.checkQuota(txn, tab.Owner)
+}
+
+// GetQuotaReport shows how much a user stores and how much they may store.
+func (s Store) GetQuotaReport(name string) (QuotaReport, error) {
+	var res QuotaReport
+	err := s.db.View(func(txn Txn) error {
+		var user User
+		err := getJSON(txn, prefix(userPrefix, name), &user)
+		if err != nil {
+			return err
+		}
+
+		usage, err := userUsage(txn, &user)
+		if err != nil {
+			return err
+		}
+
+		res = QuotaReport{
+			Name:     user.Name,
+			Usage:    usage,
+			Quota:    s.quotaFor(&user),
+			Override: user.Quota != nil,
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SetQuota gives a user a quota of their own, or the default quota again
+// when quota is nil.
+func (s Store) SetQuota(name string, quota *Quota) error {
+	return s.db.Update(func(txn Txn) error {
+		var user User
+		err := getJSON(txn, prefix(userPrefix, name), &user)
+		if err != nil {
+			return err
+		}
+
+		user.Quota = quota
+		return setJSON(txn, prefix(userPrefix, name), &user)
+	})
+}
+
+// tabSize looks up the size of a stored tab, for the wrappers which only
+// get an id.
+func tabSize(txn Txn, id uuid.UUID) (int, error) {
+	var tab Tab
+	err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return tab.ContentSize, err
+}
+
+// writeQuotaError answers a request which failed because of a quota, and
+// reports whether err was a quota error.
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case ErrTabQuota:
+		w.WriteHeader(http.StatusForbidden)
+	case ErrByteQuota:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	default:
+		return false
+	}
+
+	_, _ = w.Write([]byte(err.Error()))
+	return true
+}
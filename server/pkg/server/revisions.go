@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const revisionPrefix = "rev_"
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is a single saved version of a tab's contents.
+// The id is the unix nano timestamp of the save, zero padded so
+// revisions of a tab sort chronologically by key.
+type Revision struct {
+	Schema    int
+	Id        string
+	Tab       uuid.UUID
+	Author    string
+	Timestamp time.Time
+	Size      int
+	Contents  string
+}
+
+func (r *Revision) setSchema(version int) {
+	r.Schema = version
+}
+
+// RevisionPolicy decides which old revisions survive pruning. The newest
+// KeepLast revisions are always kept, and on top of that the newest revision
+// of each of the last KeepDays days. KeepLast <= 0 disables pruning and
+// KeepDays <= 0 keeps one revision per day forever.
+type RevisionPolicy struct {
+	KeepLast int
+	KeepDays int
+}
+
+var DefaultRevisionPolicy = RevisionPolicy{
+	KeepLast: 50,
+	KeepDays: 30,
+}
+
+func envInt(name string, def int) int {
+	env := os.Getenv(name)
+	if env == "" {
+		return def
+	}
+
+	res, err := strconv.Atoi(env)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %d", env, name, def)
+		return def
+	}
+
+	return res
+}
+
+func revisionPolicy() RevisionPolicy {
+	return RevisionPolicy{
+		KeepLast: envInt("REVISION_KEEP_LAST", DefaultRevisionPolicy.KeepLast),
+		KeepDays: envInt("REVISION_KEEP_DAYS", DefaultRevisionPolicy.KeepDays),
+	}
+}
+
+func revisionTabPrefix(tab uuid.UUID) []byte {
+	return prefix(revisionPrefix, tab.String()+"_")
+}
+
+func revisionKey(tab uuid.UUID, id string) []byte {
+	return prefix(revisionPrefix, fmt.Sprintf("%s_%s", tab.String(), id))
+}
+
+func newRevisionId(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+func revisionTime(id string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// SetTabWithRevision stores the tab like SetTab with author as the editor,
+// and records its contents as a new revision in the same transaction.
+func (s Store) SetTabWithRevision(tab *Tab, author string) (*Revision, error) {
+	now := time.Now()
+	rev := Revision{
+		Id:        newRevisionId(now),
+		Tab:       tab.Id,
+		Author:    author,
+		Timestamp: now,
+		Size:      len(tab.Contents),
+		Contents:  tab.Contents,
+	}
+
+	touchTab(tab, author, now)
+
+	return &rev, s.db.Update(func(txn Txn) error {
+		err := s.resizeTab(txn, tab)
+		if err != nil {
+			return err
+		}
+
+		err = putTab(txn, tab)
+		if err != nil {
+			return err
+		}
+
+		err = setJSON(txn, revisionKey(tab.Id, rev.Id), &rev)
+		if err != nil {
+			return err
+		}
+
+		return pruneRevisions(txn, tab.Id, s.RevisionPolicy, now)
+	})
+}
+
+// GetRevisions lists all revisions of a tab, newest first. Contents
+// are left out, use GetRevision to fetch a single revision in full.
+func (s Store) GetRevisions(tab uuid.UUID) ([]Revision, error) {
+	res := []Revision{}
+	return res, s.db.View(func(txn Txn) error {
+		return txn.Iterate(revisionTabPrefix(tab), true, func(key []byte, val []byte) error {
+			var rev Revision
+			err := decodeJSON(key, val, &rev)
+			if err != nil {
+				return err
+			}
+
+			rev.Contents = ""
+			res = append(res, rev)
+			return nil
+		})
+	})
+}
+
+func (s Store) GetRevision(tab uuid.UUID, id string) (*Revision, error) {
+	var res Revision
+	return &res, s.db.View(func(txn Txn) error {
+		err := getJSON(txn, revisionKey(tab, id), &res)
+		if err == ErrNotFound {
+			return ErrRevisionNotFound
+		}
+		return err
+	})
+}
+
+// RestoreRevision makes the contents of an old revision the current contents
+// of the tab. The restore is itself recorded as a new revision, so it can be undone.
+func (s Store) RestoreRevision(tab *Tab, id string, author string) (*Revision, error) {
+	rev, err := s.GetRevision(tab.Id, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tab.Contents = rev.Contents
+	return s.SetTabWithRevision(tab, author)
+}
+
+func rmRevisions(txn Txn, tab uuid.UUID) error {
+	var keys [][]byte
+	err := txn.IterateKeys(revisionTabPrefix(tab), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pruneRevisions(txn Txn, tab uuid.UUID, policy RevisionPolicy, now time.Time) error {
+	if policy.KeepLast <= 0 {
+		return nil
+	}
+
+	var ids []string
+	p := revisionTabPrefix(tab)
+	err := txn.IterateKeys(p, func(key []byte) error {
+		ids = append(ids, string(key[len(p):]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range prunedRevisions(ids, policy, now) {
+		if err := txn.Delete(revisionKey(tab, id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prunedRevisions returns the ids which should be deleted under the policy.
+func prunedRevisions(ids []string, policy RevisionPolicy, now time.Time) []string {
+	if len(ids) <= policy.KeepLast {
+		return nil
+	}
+
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	var cutoff time.Time
+	if policy.KeepDays > 0 {
+		cutoff = now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -policy.KeepDays+1)
+	}
+
+	var res []string
+	days := map[string]bool{}
+	for i, id := range ids {
+		t, err := revisionTime(id)
+		if err != nil {
+			// not something we created, leave it alone
+			continue
+		}
+
+		day := t.UTC().Format("2006-01-02")
+		newestOfDay := !days[day]
+		days[day] = true
+
+		if i < policy.KeepLast {
+			continue
+		}
+		if newestOfDay && !t.Before(cutoff) {
+			continue
+		}
+
+		res = append(res, id)
+	}
+
+	return res
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrInvalidSearch = errors.New("invalid search")
+
+// The search index is a secondary index like the others, with a key per term
+// in a tab: idx_term_<term>\x00<field><id>. It is kept up to date by putTab
+// and deleteTab, and rebuilt together with the other indexes. In an
+// encrypted store the terms are blinded, see EncryptedBackend.
+const searchIndexPrefix = indexPrefix + "term_"
+
+const (
+	searchFieldName    = 'n'
+	searchFieldSection = 's'
+	searchFieldOwner   = 'o'
+	searchFieldTag     = 't'
+)
+
+// a match in the name of a tab counts for more than one in a section name
+var searchFieldWeights = map[byte]float64{
+	searchFieldName:    4,
+	searchFieldTag:     3,
+	searchFieldOwner:   2,
+	searchFieldSection: 1,
+}
+
+const (
+	searchExactWeight  = 1
+	searchPrefixWeight = 0.6
+	searchFuzzyWeight  = 0.3
+)
+
+const DefaultSearchLimit = 50
+
+// Visibility filters of a SearchQuery.
+const (
+	SearchPublic  = "public"
+	SearchPrivate = "private"
+)
+
+type SearchQuery struct {
+	Text string
+	// Owner only returns tabs of this user when set.
+	Owner string
+	// Visibility is SearchPublic, SearchPrivate or empty for both.
+	Visibility string
+	// User is who is searching, or nil when not logged in. Private tabs
+	// are only found by their owner and admins.
+	User  *User
+	Limit int
+}
+
+type SearchResult struct {
+	Tab   Tab
+	Score float64
+}
+
+// searchTerms splits text into lower case words.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func searchIndexKey(term string, field byte, tab *Tab) []byte {
+	key := prefix(searchIndexPrefix, term+"\x00")
+	key = append(key, field)
+	return append(key, tab.Id.String()...)
+}
+
+// splitSearchIndexKey returns the term and field of a search index key.
+func splitSearchIndexKey(key []byte) (string, byte, bool) {
+	rest := key[len(searchIndexPrefix):]
+	i := strings.IndexByte(string(rest), 0)
+	if i < 0 || len(rest) != i+2+36 {
+		return "", 0, false
+	}
+	return string(rest[:i]), rest[i+1], true
+}
+
+// tabSearchKeys are the search index keys of a tab. Contents which can't be
+// decoded are not indexed, the tab can still be found by its owner.
+func tabSearchKeys(txn Txn, tab *Tab) [][]byte {
+	var contents struct {
+		Name     string
+		Sections []struct {
+			Name string
+		}
+	}
+	_ = json.Unmarshal([]byte(tab.Contents), &contents)
+
+	seen := map[string]bool{}
+	var keys [][]byte
+	add := func(text string, field byte) {
+		for _, term := range searchTerms(text) {
+			term, _ = indexText(txn, term)
+			key := searchIndexKey(term, field, tab)
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	add(contents.Name, searchFieldName)
+	for _, section := range contents.Sections {
+		add(section.Name, searchFieldSection)
+	}
+	for _, tag := range tab.Tags {
+		add(tag, searchFieldTag)
+	}
+	add(tab.Owner, searchFieldOwner)
+
+	return keys
+}
+
+// maxEditDistance is how many typos are forgiven in a search term.
+func maxEditDistance(term string) int {
+	n := utf8.RuneCountInString(term)
+	switch {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editDistance is the levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// matchWeight says how well an indexed term matches a word of the query,
+// 0 meaning not at all.
+func matchWeight(word, term string) float64 {
+	switch {
+	case term == word:
+		return searchExactWeight
+	case strings.HasPrefix(term, word):
+		return searchPrefixWeight
+	}
+
+	max := maxEditDistance(word)
+	if max == 0 {
+		return 0
+	}
+	// the distance is at least the difference in length
+	diff := utf8.RuneCountInString(term) - utf8.RuneCountInString(word)
+	if diff > max || -diff > max {
+		return 0
+	}
+	if editDistance(word, term) <= max {
+		return searchFuzzyWeight
+	}
+	return 0
+}
+
+// Search finds tabs matching every word of the query, best matches first.
+// Words match indexed terms exactly, as a prefix or with a few typos. Typos
+// in the first letter are not forgiven, so only terms starting with the same
+// letter have to be looked at. In an encrypted store the terms are blinded,
+// and words only match them exactly.
+func (s Store) Search(query SearchQuery) ([]SearchResult, error) {
+	if query.Visibility != "" && query.Visibility != SearchPublic && query.Visibility != SearchPrivate {
+		return nil, ErrInvalidSearch
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultSearchLimit
+	}
+
+	words := searchTerms(query.Text)
+	res := []SearchResult{}
+	if len(words) == 0 {
+		return res, nil
+	}
+
+	err := s.db.View(func(txn Txn) error {
+		var scores map[string]float64
+		for _, word := range words {
+			_, size := utf8.DecodeRuneInString(word)
+			p := prefix(searchIndexPrefix, word[:size])
+			blinded, isBlinded := indexText(txn, word)
+			if isBlinded {
+				p = prefix(searchIndexPrefix, blinded+"\x00")
+			}
+
+			best := map[string]float64{}
+			err := txn.IterateKeys(p, func(key []byte) error {
+				term, field, ok := splitSearchIndexKey(key)
+				if !ok {
+					return nil
+				}
+
+				weight := float64(searchExactWeight)
+				if !isBlinded {
+					weight = matchWeight(word, term)
+				}
+				score := weight * searchFieldWeights[field]
+				id := string(key[len(key)-36:])
+				if score > best[id] {
+					best[id] = score
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// a tab has to match every word
+			if scores == nil {
+				scores = best
+				continue
+			}
+			for id, score := range scores {
+				if best[id] == 0 {
+					delete(scores, id)
+				} else {
+					scores[id] = score + best[id]
+				}
+			}
+		}
+
+		for id, score := range scores {
+			if score == 0 {
+				continue
+			}
+
+			var tab Tab
+			err := getJSON(txn, prefix(tabPrefix, id), &tab)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if !query.matches(&tab) {
+				continue
+			}
+
+			res = append(res, SearchResult{Tab: tab, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := &res[i], &res[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.Tab.UpdatedAt.Equal(b.Tab.UpdatedAt) {
+			return a.Tab.UpdatedAt.After(b.Tab.UpdatedAt)
+		}
+		return a.Tab.Id.String() < b.Tab.Id.String()
+	})
+
+	if len(res) > query.Limit {
+		res = res[:query.Limit]
+	}
+	return res, nil
+}
+
+// matches applies the filters of the query, and hides private tabs from
+// everyone but their owner and admins.
+func (q *SearchQuery) matches(tab *Tab) bool {
+	if !tab.Public && (q.User == nil || (!q.User.Admin && q.User.Name != tab.Owner)) {
+		return false
+	}
+	if q.Owner != "" && tab.Owner != q.Owner {
+		return false
+	}
+
+	switch q.Visibility {
+	case SearchPublic:
+		return tab.Public
+	case SearchPrivate:
+		return !tab.Public
+	}
+	return true
+}
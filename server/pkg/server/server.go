@@ -7,9 +7,13 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/google/uuid"
+	"github.com/jonay2000/ainulindale/server/pkg/tabdata"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func dbLocation() string {
@@ -24,6 +28,25 @@ func dbLocation() string {
 	}
 }
 
+// OpenStore opens the store at DB_LOCATION, configured from the environment.
+// It is encrypted with the key in ENCRYPTION_KEY_FILE or ENCRYPTION_KEY.
+func OpenStore() (*Store, error) {
+	backend, err := OpenBackend(dbLocation())
+	if err != nil {
+		return nil, err
+	}
+	backend, err = withEncryption(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewStoreWithBackend(backend)
+	store.RevisionPolicy = revisionPolicy()
+	store.Quota = defaultQuota()
+
+	return store, nil
+}
+
 func StartServer() error {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -43,13 +66,44 @@ func StartServer() error {
 
 	gob.Register(SessionUser{})
 
-	store, err := NewStore(dbLocation())
+	store, err := OpenStore()
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	lm, err := NewLoginManager(store)
+	// records are upgraded lazily on read as well, this just saves doing it again every time
+	if os.Getenv("MIGRATE_ON_STARTUP") != "false" {
+		report, err := store.Migrate(false)
+		if err != nil {
+			return err
+		}
+		log.Printf("migrations: %s", report)
+	}
+
+	upToDate, err := store.IndexesUpToDate()
+	if err != nil {
+		return err
+	}
+	if !upToDate {
+		log.Printf("rebuilding indexes")
+		n, err := store.RebuildIndexes()
+		if err != nil {
+			return err
+		}
+		log.Printf("indexed %d tabs", n)
+	}
+
+	stopJanitor := store.StartJanitor(trashRetention())
+	defer stopJanitor()
+
+	waitRecompress := store.StartRecompress()
+	defer waitRecompress()
+
+	var userStore UserStore = store
+	var tabStore TabStore = store
+
+	lm, err := NewLoginManager(userStore)
 	if err != nil {
 		return err
 	}
@@ -167,6 +221,207 @@ func StartServer() error {
 		return
 	})
 
+	r.Post("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Since uint64
+			Token string
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := lm.DecodeToken(body.Token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !user.Admin {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// the version to continue from is only known once the whole backup is written
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Trailer", "Backup-Version")
+
+		version, err := store.Backup(w, body.Since)
+		if err == ErrBackupUnsupported {
+			w.WriteHeader(http.StatusNotImplemented)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			// the response has most likely started already, the missing
+			// trailer tells the client the backup is incomplete
+			log.Printf("%v", err)
+			return
+		}
+
+		w.Header().Set("Backup-Version", strconv.FormatUint(version, 10))
+	})
+
+	r.Post("/admin/compression", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Token string
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := lm.DecodeToken(body.Token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !user.Admin {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		stats, err := store.CompressionStats()
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := struct {
+			CompressionStats
+			Ratio float64
+		}{stats, stats.Ratio()}
+
+		err = json.NewEncoder(w).Encode(&res)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	})
+
+	r.Post("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Run   bool // collect garbage now, and answer once it is done
+			Token string
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := lm.DecodeToken(body.Token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !user.Admin {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var res MaintenanceStatus
+		if body.Run {
+			res = store.RunMaintenance()
+		} else {
+			res = store.MaintenanceStatus()
+		}
+
+		err = json.NewEncoder(w).Encode(&res)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	})
+
+	r.Put("/admin/quota", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Name  string
+			Quota *Quota // nil to go back to the default quota
+			Token string
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := lm.DecodeToken(body.Token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !user.Admin {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		err = userStore.SetQuota(body.Name, body.Quota)
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r.Post("/user/usage", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Name  string // defaults to yourself, only admins can see others
+			Token string
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := lm.DecodeToken(body.Token)
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if body.Name == "" {
+			body.Name = user.Name
+		}
+		if !user.Admin && user.Name != body.Name {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		res, err := userStore.GetQuotaReport(body.Name)
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(&res)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	})
+
 	r.Delete("/user", func(w http.ResponseWriter, r *http.Request) {
 		var body struct {
 			Name string
@@ -192,14 +447,14 @@ func StartServer() error {
 			return
 		}
 
-		userToDelete, err := store.GetUser(body.Name)
+		userToDelete, err := userStore.GetUser(body.Name)
 		if err != nil {
 			log.Printf("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		num, err := store.CountAdminUsers()
+		num, err := userStore.CountAdminUsers()
 		if err != nil {
 			log.Printf("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -213,7 +468,7 @@ func StartServer() error {
 			return
 		}
 
-		err = store.RmUser(body.Name)
+		err = userStore.RmUser(body.Name)
 		if err != nil {
 			log.Printf("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -227,6 +482,7 @@ func StartServer() error {
 	r.Post("/user/get-all", func(w http.ResponseWriter, r *http.Request) {
 		var body struct {
 			Token string
+			Page
 		}
 
 		err = json.NewDecoder(r.Body).Decode(&body)
@@ -249,18 +505,27 @@ func StartServer() error {
 			return
 		}
 
-		users, err := store.GetUsers()
+		res, err := userStore.GetUsersPage(body.Page)
+		if err == ErrInvalidSort || err == ErrInvalidCursor {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			log.Printf("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		for i := 0; i < len(users); i++ {
-			users[i].Password = nil
+		for i := 0; i < len(res.Users); i++ {
+			res.Users[i].Password = nil
 		}
 
-		err = json.NewEncoder(w).Encode(&users)
+		if body.Paginated() {
+			err = json.NewEncoder(w).Encode(&res)
+		} else {
+			err = json.NewEncoder(w).Encode(&res.Users)
+		}
 		if err != nil {
 			log.Printf("%v", err)
 		}
@@ -299,6 +564,12 @@ func StartServer() error {
 			return
 		}
 
+		if strings.ContainsRune(body.Username, 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("username cannot contain zero bytes"))
+			return
+		}
+
 		newUser := User{
 			Name:     body.Username,
 			Password: []byte(body.Password),
@@ -343,6 +614,7 @@ func StartServer() error {
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusUnauthorized)
+				return
 			}
 
 
@@ -353,19 +625,23 @@ func StartServer() error {
 				return
 			}
 
-			alias, err := store.GetTab(tabId)
+			alias, err := tabStore.GetTab(tabId)
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if alias == nil || alias.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
 
 			if alias.Owner != user.Name && !user.Admin {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			err = store.RmTab(alias)
+			err = tabStore.TrashTab(alias, user.Name)
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -376,12 +652,15 @@ func StartServer() error {
 			return
 		})
 
-		r.Post("/new", func(w http.ResponseWriter, r *http.Request) {
+		r.Post("/trash", func(w http.ResponseWriter, r *http.Request) {
 			var body struct {
+				All   bool
+				Sort  string
+				Desc  bool
 				Token string
 			}
 
-			err = json.NewDecoder(r.Body).Decode(&body)
+			err := json.NewDecoder(r.Body).Decode(&body)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
@@ -394,33 +673,43 @@ func StartServer() error {
 				return
 			}
 
-			tab := Tab{
-				Id:       uuid.New(),
-				Owner:    user.Name,
-				Public:   false,
-				Contents: "",
+			if body.All && !user.Admin {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
 			}
 
-			err = store.CreateTab(tab)
+			var res []Tab
+			if body.All {
+				res, err = tabStore.GetAllTrash()
+			} else {
+				res, err = tabStore.GetTrash(user.Name)
+			}
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			err = json.NewEncoder(w).Encode(tab)
+			err = sortTabs(res, body.Sort, body.Desc)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
 			if err != nil {
 				log.Printf("%v", err)
 			}
-			return
 		})
 
-		r.Post("/all-for-user", func(w http.ResponseWriter, r *http.Request) {
+		r.Put("/restore", func(w http.ResponseWriter, r *http.Request) {
 			var body struct {
+				Id    string
 				Token string
 			}
 
-			err = json.NewDecoder(r.Body).Decode(&body)
+			err := json.NewDecoder(r.Body).Decode(&body)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
@@ -433,36 +722,47 @@ func StartServer() error {
 				return
 			}
 
-			res, err := store.GetUserTabs(&user)
+			id, err := uuid.Parse(body.Id)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			err = json.NewEncoder(w).Encode(&res)
+			tab, err := tabStore.GetTab(id)
 			if err != nil {
 				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
 			}
-		})
 
-		r.Post("/all-public", func(w http.ResponseWriter, r *http.Request) {
-			res, err := store.GetPublicTabs()
+			if tab.Owner != user.Name && !user.Admin {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			err = tabStore.RestoreTab(tab, user.Name)
+			if writeQuotaError(w, err) {
+				return
+			}
 			if err != nil {
+				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			err = json.NewEncoder(w).Encode(&res)
+			err = json.NewEncoder(w).Encode(tab)
 			if err != nil {
 				log.Printf("%v", err)
 			}
 		})
 
-		r.Put("/", func(w http.ResponseWriter, r *http.Request) {
+		r.Post("/new", func(w http.ResponseWriter, r *http.Request) {
 			var body struct {
 				Token string
-				Data string
-				Id string
 			}
 
 			err = json.NewDecoder(r.Body).Decode(&body)
@@ -477,41 +777,37 @@ func StartServer() error {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			id, err := uuid.Parse(body.Id)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
 
-			tab, err := store.GetTab(id)
-			if err != nil {
-				log.Printf("%v", err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
+			tab := Tab{
+				Id:       uuid.New(),
+				Owner:    user.Name,
+				Public:   false,
+				Contents: "",
 			}
 
-			if tab.Owner != user.Name {
-				w.WriteHeader(http.StatusUnauthorized)
+			err = tabStore.CreateTab(&tab)
+			if writeQuotaError(w, err) {
 				return
 			}
-
-			tab.Contents = body.Data
-
-			err = store.SetTab(tab.Id, tab)
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			w.WriteHeader(http.StatusOK)
-		})
-
-		r.Put("/public", func(w http.ResponseWriter, r *http.Request) {
-			var body struct {
+			err = json.NewEncoder(w).Encode(tab)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+			return
+		})
+
+		r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
 				Token string
-				Id string
-				Public bool
+				Format string
+				Data string
+				Track int
 			}
 
 			err = json.NewDecoder(r.Body).Decode(&body)
@@ -526,73 +822,325 @@ func StartServer() error {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			id, err := uuid.Parse(body.Id)
+
+			data, warnings, err := importTab(body.Format, body.Data, body.Track)
+			if writeImportError(w, err) {
+				return
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			tab := Tab{
+				Id:     uuid.New(),
+				Owner:  user.Name,
+				Public: false,
+			}
+			data.Id = tab.Id.String()
+
+			err = data.Validate()
+			if writeImportError(w, err) {
+				return
+			}
+
+			contents, err := json.Marshal(data)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			tab.Contents = string(contents)
+
+			err = tabStore.CreateTab(&tab)
+			if writeQuotaError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			tab, err := store.GetTab(id)
+			err = json.NewEncoder(w).Encode(ImportedTab{tab, warnings})
 			if err != nil {
 				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/all-for-user", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token      string
+				Collection string // optional, only list the tabs in this collection
+				Tag        string // optional, only list the tabs with this tag
+				Page
+			}
+
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			if tab.Owner != user.Name {
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			tab.Public = body.Public
+			var res TabPage
+			if body.Collection != "" && body.Tag != "" {
+				writeTagError(w, ErrTagAndCollection)
+				return
+			} else if body.Tag != "" {
+				res, err = tabStore.GetTaggedTabsPage(user.Name, body.Tag, body.Page)
+			} else if body.Collection == "" {
+				res, err = tabStore.GetUserTabsPage(user.Name, body.Page)
+			} else {
+				var id uuid.UUID
+				id, err = uuid.Parse(body.Collection)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				var c *Collection
+				c, err = tabStore.GetCollection(id)
+				if writeCollectionError(w, err) {
+					return
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if c.Owner != user.Name {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				res, err = tabStore.GetCollectionTabsPage(id, true, body.Page)
+			}
+			if writeTagError(w, err) {
+				return
+			}
+			if err == ErrInvalidSort || err == ErrInvalidCursor {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if body.Paginated() {
+				err = json.NewEncoder(w).Encode(&res)
+			} else {
+				err = json.NewEncoder(w).Encode(&res.Tabs)
+			}
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/all-public", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Tag string // optional, only list the tabs with this tag
+				Page
+			}
+
+			// the body is optional here
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var page TabPage
+			if body.Tag != "" {
+				page, err = tabStore.GetTaggedTabsPage("", body.Tag, body.Page)
+			} else {
+				page, err = tabStore.GetPublicTabsPage(body.Page)
+			}
+			if writeTagError(w, err) {
+				return
+			}
+			if err == ErrInvalidSort || err == ErrInvalidCursor {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 
-			err = store.SetTab(tab.Id, tab)
+			res := StarredTabPage{Next: page.Next, Total: page.Total}
+			res.Tabs, err = tabStore.WithStars(page.Tabs)
 			if err != nil {
 				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			w.WriteHeader(http.StatusOK)
+			if body.Paginated() {
+				err = json.NewEncoder(w).Encode(&res)
+			} else {
+				err = json.NewEncoder(w).Encode(&res.Tabs)
+			}
+			if err != nil {
+				log.Printf("%v", err)
+			}
 		})
 
+		r.Put("/tags", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Tags  []string
+				Token string
+			}
 
-		r.Post("/get", func(w http.ResponseWriter, r *http.Request) {
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.AddTags(id, body.Tags)
+			if writeTagError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Delete("/tags", func(w http.ResponseWriter, r *http.Request) {
 			var body struct {
-				Id string
+				Id    string
+				Tags  []string
 				Token string
 			}
 
-			err = json.NewDecoder(r.Body).Decode(&body)
+			err := json.NewDecoder(r.Body).Decode(&body)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
 			id, err := uuid.Parse(body.Id)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			res, err := store.GetTab(id)
+			tab, err := tabStore.GetTab(id)
 			if err != nil {
+				log.Printf("%v", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
 
-			if !res.Public {
-				user, err := lm.DecodeToken(body.Token)
+			if tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.RemoveTags(id, body.Tags)
+			if writeTagError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/tags/suggest", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Prefix string
+				Limit  int
+				Token  string // optional, to include the tags of your own tabs
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var user *User
+			if body.Token != "" {
+				decoded, err := lm.DecodeToken(body.Token)
 				if err != nil {
 					log.Printf("%v", err)
 					w.WriteHeader(http.StatusUnauthorized)
 					return
 				}
+				user = &decoded
+			}
 
-				if user.Name != res.Owner {
-					w.WriteHeader(http.StatusUnauthorized)
-					return
-				}
+			res, err := tabStore.SuggestTags(body.Prefix, user, body.Limit)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
 
 			err = json.NewEncoder(w).Encode(&res)
@@ -600,8 +1148,1406 @@ func StartServer() error {
 				log.Printf("%v", err)
 			}
 		})
-	})
 
+		r.Put("/star", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if !tab.Public && tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			stars, err := tabStore.StarTab(id, user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res := struct {
+				Stars int
+			}{stars}
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Delete("/star", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			stars, err := tabStore.UnstarTab(id, user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res := struct {
+				Stars int
+			}{stars}
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/favorites", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+				Page
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.GetFavoritesPage(user.Name, body.Page)
+			if err == ErrInvalidSort || err == ErrInvalidCursor {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if body.Paginated() {
+				err = json.NewEncoder(w).Encode(&res)
+			} else {
+				err = json.NewEncoder(w).Encode(&res.Tabs)
+			}
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/search", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Query      string
+				Owner      string
+				Visibility string
+				Limit      int
+				Token      string // optional, to find your own private tabs
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			query := SearchQuery{
+				Text:       body.Query,
+				Owner:      body.Owner,
+				Visibility: body.Visibility,
+				Limit:      body.Limit,
+			}
+
+			if body.Token != "" {
+				user, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				query.User = &user
+			}
+
+			res, err := tabStore.Search(query)
+			if err == ErrInvalidSearch {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Put("/", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+				Data string
+				Id string
+			}
+
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			data, err := tabdata.Parse([]byte(body.Data))
+			if err == nil && data.Id != tab.Id.String() {
+				err = tabdata.Errors{{Path: "$.id", Message: "does not match the id of the tab"}}
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+
+			tab.Contents = body.Data
+
+			_, err = tabStore.SetTabWithRevision(tab, user.Name)
+			if writeQuotaError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r.Put("/public", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+				Id string
+				Public bool
+			}
+
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			tab.Public = body.Public
+			tab.LastEditedBy = user.Name
+
+			err = tabStore.SetTab(tab.Id, tab)
+			if writeQuotaError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r.Put("/owner", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id            string
+				To            string
+				RequireAccept bool // offer the tab instead of handing it over
+				Token         string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if tab.Owner != user.Name && !user.Admin {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var res interface{}
+			if body.RequireAccept {
+				res, err = tabStore.OfferTab(id, body.To, user.Name)
+			} else {
+				res, err = tabStore.TransferTab(id, body.To, user.Name)
+			}
+			if writeTransferError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/transfers", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var res struct {
+				Incoming []Transfer
+				Outgoing []Transfer
+			}
+			res.Incoming, res.Outgoing, err = tabStore.GetTransfers(user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		// The recipient accepts or declines a transfer, the owner or an admin
+		// can withdraw it by not accepting.
+		r.Put("/transfer", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id     string
+				Accept bool
+				Token  string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			transfer, err := tabStore.GetTransfer(id)
+			if writeTransferError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			recipient := transfer.To == user.Name
+			if !recipient && (body.Accept || (transfer.From != user.Name && !user.Admin)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if !body.Accept {
+				err = tabStore.CancelTransfer(id, user.Name)
+				if writeTransferError(w, err) {
+					return
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			tab, err := tabStore.AcceptTransfer(id, user.Name)
+			if writeTransferError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(tab)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/audit", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// the trail of purged tabs is only left to admins
+			if !user.Admin {
+				tab, err := tabStore.GetTab(id)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if tab == nil || tab.Owner != user.Name {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			res, err := tabStore.GetAudit(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+
+		r.Post("/revisions", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if !tab.Public {
+				user, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				if user.Name != tab.Owner {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			res, err := tabStore.GetRevisions(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/revision", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id       string
+				Revision string
+				Token    string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if !tab.Public {
+				user, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				if user.Name != tab.Owner {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			res, err := tabStore.GetRevision(id, body.Revision)
+			if err == ErrRevisionNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Put("/revision", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id       string
+				Revision string
+				Token    string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			tab, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if tab == nil || tab.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if tab.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.RestoreRevision(tab, body.Revision, user.Name)
+			if err == ErrRevisionNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if writeQuotaError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res.Contents = ""
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/{id}/fork", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(chi.URLParam(r, "id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			source, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if source == nil || source.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			// anyone can fork public tabs, only the owner can duplicate private ones
+			if !source.Public && source.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			tab, err := tabStore.ForkTab(id, user.Name)
+			if writeQuotaError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(tab)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/{id}/forks", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+			}
+
+			// the token is optional for public tabs
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.Parse(chi.URLParam(r, "id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			source, err := tabStore.GetTab(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if source == nil || source.TrashedAt != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			var user *User
+			if body.Token != "" {
+				decoded, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				user = &decoded
+			}
+
+			if !source.Public && (user == nil || user.Name != source.Owner) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			forks, err := tabStore.GetForks(id)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			// every fork is counted, but private forks are only listed to
+			// their owner
+			res := struct {
+				Count int
+				Forks []Tab
+			}{
+				Count: len(forks),
+				Forks: []Tab{},
+			}
+			for _, fork := range forks {
+				if fork.Public || (user != nil && user.Name == fork.Owner) {
+					res.Forks = append(res.Forks, fork)
+				}
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Get("/{id}/export.txt", func(w http.ResponseWriter, r *http.Request) {
+			width := tabdata.DefaultLineWidth
+			if param := r.URL.Query().Get("width"); param != "" {
+				n, err := strconv.Atoi(param)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte("width must be a number"))
+					return
+				}
+				width = n
+			}
+
+			_, data, ok := exportTab(w, r, tabStore, lm)
+			if !ok {
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(data.ASCII(width)))
+		})
+
+		r.Get("/{id}/export.musicxml", func(w http.ResponseWriter, r *http.Request) {
+			tab, data, ok := exportTab(w, r, tabStore, lm)
+			if !ok {
+				return
+			}
+
+			res, err := data.MusicXML()
+			if err != nil {
+				log.Printf("tab %s: %v", tab.Id, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/vnd.recordare.musicxml+xml")
+			w.Header().Set("Content-Disposition", exportDisposition(tab, "musicxml"))
+			_, _ = w.Write(res)
+		})
+
+		r.Post("/get", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id string
+				Token string
+			}
+
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			res, err := tabStore.GetTab(id)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if res == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			// trashed tabs are only visible to their owner
+			if !res.Public || res.TrashedAt != nil {
+				user, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				if user.Name != res.Owner {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+	})
+
+
+	r.Route("/collection", func(r chi.Router) {
+		r.Post("/new", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Name   string
+				Parent string // empty for a top level collection
+				Token  string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			parent, err := parseOptionalId(body.Parent)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			res, err := tabStore.CreateCollection(user.Name, body.Name, parent)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/all", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var res struct {
+				Own    []Collection
+				Shared []Collection // collections of others shared with the user
+			}
+			res.Own, res.Shared, err = tabStore.GetCollections(user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Post("/get", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string // optional for public collections
+				Page
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var user *User
+			if body.Token != "" {
+				decoded, err := lm.DecodeToken(body.Token)
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				user = &decoded
+			}
+
+			c, err := tabStore.GetCollection(id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if !c.VisibleTo(user) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			tabs, err := tabStore.GetCollectionTabsPage(id, c.ShowsAllTabsTo(user), body.Page)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res := struct {
+				Collection *Collection
+				Tabs       TabPage
+			}{c, tabs}
+			err = json.NewEncoder(w).Encode(&res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Put("/name", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Name  string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			c, err := tabStore.GetCollection(id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if c.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.RenameCollection(c.Id, body.Name)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		// moves a collection into another one, or to the top level
+		r.Put("/parent", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id     string
+				Parent string
+				Token  string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			c, err := tabStore.GetCollection(id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if c.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			parent, err := parseOptionalId(body.Parent)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			res, err := tabStore.MoveCollection(c.Id, parent)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		r.Put("/order", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Parent string
+				Ids    []uuid.UUID // the collections in Parent in their new order
+				Token  string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			parent, err := parseOptionalId(body.Parent)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			err = tabStore.ReorderCollections(user.Name, parent, body.Ids)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r.Put("/sharing", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id         string
+				Public     bool
+				SharedWith []string
+				Token      string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			c, err := tabStore.GetCollection(id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if c.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			res, err := tabStore.ShareCollection(c.Id, body.Public, body.SharedWith)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(res)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		})
+
+		// deleting a collection keeps its tabs
+		r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Id    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := uuid.Parse(body.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			c, err := tabStore.GetCollection(id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if c.Owner != user.Name {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			err = tabStore.DeleteCollection(c.Id)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		// From empty adds the tabs to To, To empty removes them from From
+		r.Put("/tabs", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Tabs  []uuid.UUID
+				From  string
+				To    string
+				Token string
+			}
+
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			user, err := lm.DecodeToken(body.Token)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			from, err := parseOptionalId(body.From)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			to, err := parseOptionalId(body.To)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			err = tabStore.MoveTabs(user.Name, body.Tabs, from, to)
+			if writeCollectionError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+	})
 
 	url := "0.0.0.0:3000"
 	log.Printf("listening on %s", url)
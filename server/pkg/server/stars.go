@@ -0,0 +1,189 @@
+package server
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Stars relate users to the tabs they want to come back to. They are kept
+// both ways: star_<user>\x00<time>\x00<tab> lists the favorites of a user
+// in the order they were starred, and starred_<tab>\x00<user> counts the
+// stars of a tab and holds the time to find the first key again. They are
+// not indexes, which can be rebuilt from the tabs, so they live outside idx_.
+const starPrefix = "star_"
+const starredPrefix = "starred_"
+
+func starPrefixFor(name string) []byte {
+	return prefix(starPrefix, name+"\x00")
+}
+
+func starKey(name string, starred string, id uuid.UUID) []byte {
+	return append(starPrefixFor(name), starred+"\x00"+id.String()...)
+}
+
+func starredPrefixFor(id uuid.UUID) []byte {
+	return prefix(starredPrefix, id.String()+"\x00")
+}
+
+func starredKey(id uuid.UUID, name string) []byte {
+	return append(starredPrefixFor(id), name...)
+}
+
+// StarredTab is a tab with the number of users who starred it.
+type StarredTab struct {
+	Tab
+	Stars int
+}
+
+type StarredTabPage struct {
+	Tabs  []StarredTab
+	Next  string
+	Total int
+}
+
+func countStars(txn Txn, id uuid.UUID) (int, error) {
+	res := 0
+	err := txn.IterateKeys(starredPrefixFor(id), func(_ []byte) error {
+		res += 1
+		return nil
+	})
+	return res, err
+}
+
+// StarTab adds a tab to the favorites of a user, and returns how many users
+// starred it.
+func (s Store) StarTab(id uuid.UUID, name string) (int, error) {
+	res := 0
+	err := s.db.Update(func(txn Txn) error {
+		_, err := txn.Get(starredKey(id, name))
+		if err == ErrNotFound {
+			starred := indexTime(time.Now())
+			if err := txn.Set(starKey(name, starred, id), []byte{}); err != nil {
+				return err
+			}
+			err = txn.Set(starredKey(id, name), []byte(starred))
+		}
+		if err != nil {
+			return err
+		}
+
+		res, err = countStars(txn, id)
+		return err
+	})
+	return res, err
+}
+
+// UnstarTab removes a tab from the favorites of a user, and returns how many
+// users still starred it.
+func (s Store) UnstarTab(id uuid.UUID, name string) (int, error) {
+	res := 0
+	err := s.db.Update(func(txn Txn) error {
+		err := unstar(txn, id, name)
+		if err != nil {
+			return err
+		}
+
+		res, err = countStars(txn, id)
+		return err
+	})
+	return res, err
+}
+
+func unstar(txn Txn, id uuid.UUID, name string) error {
+	starred, err := txn.Get(starredKey(id, name))
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Delete(starKey(name, string(starred), id)); err != nil {
+		return err
+	}
+	return txn.Delete(starredKey(id, name))
+}
+
+// rmTabStars removes a deleted tab from all favorites.
+func rmTabStars(txn Txn, id uuid.UUID) error {
+	var names []string
+	p := starredPrefixFor(id)
+	err := txn.IterateKeys(p, func(key []byte) error {
+		names = append(names, string(key[len(p):]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := unstar(txn, id, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rmUserStars removes the favorites of a deleted user.
+func rmUserStars(txn Txn, name string) error {
+	var ids []uuid.UUID
+	err := txn.IterateKeys(starPrefixFor(name), func(key []byte) error {
+		id, err := indexedTabId(key)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := unstar(txn, id, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithStars adds the star counts to tabs.
+func (s Store) WithStars(tabs []Tab) ([]StarredTab, error) {
+	res := make([]StarredTab, 0, len(tabs))
+	err := s.db.View(func(txn Txn) error {
+		for _, tab := range tabs {
+			stars, err := countStars(txn, tab.Id)
+			if err != nil {
+				return err
+			}
+			res = append(res, StarredTab{tab, stars})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// GetFavoritesPage lists the tabs a user starred, in the order they were
+// starred. Tabs which have been trashed, or which the user can no longer see,
+// are left out but still count towards the total.
+func (s Store) GetFavoritesPage(name string, page Page) (StarredTabPage, error) {
+	if page.Sort != "" {
+		return StarredTabPage{}, ErrInvalidSort
+	}
+
+	tabs, err := s.tabPage(starPrefixFor(name), page)
+	if err != nil {
+		return StarredTabPage{}, err
+	}
+
+	var visible []Tab
+	for _, tab := range tabs.Tabs {
+		if tab.TrashedAt == nil && (tab.Public || tab.Owner == name) {
+			visible = append(visible, tab)
+		}
+	}
+
+	res := StarredTabPage{Next: tabs.Next, Total: tabs.Total}
+	res.Tabs, err = s.WithStars(visible)
+	return res, err
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/dgraph-io/badger"
 	"github.com/google/uuid"
 	"log"
+	"time"
 )
 
 const userPrefix = "user_"
@@ -17,21 +17,106 @@ func prefix(prefix string, key string) []byte {
 	return []byte(fmt.Sprintf("%s%s", prefix, key))
 }
 
+type UserStore interface {
+	CreateUser(user User) error
+	GetUser(name string) (User, error)
+	UpdateUser(user *User) error
+	CountUsers() (int, error)
+	CountAdminUsers() (int, error)
+	GetUsers() ([]User, error)
+	GetUsersPage(page Page) (UserPage, error)
+	RmUser(name string) error
+	SetAdmin(name string, value bool) error
+	GetQuotaReport(name string) (QuotaReport, error)
+	SetQuota(name string, quota *Quota) error
+}
+
+type TabStore interface {
+	// GetTab returns a nil tab when it does not exist.
+	GetTab(id uuid.UUID) (*Tab, error)
+	CreateTab(tab *Tab) error
+	SetTab(id uuid.UUID, tab *Tab) error
+	SetTabWithRevision(tab *Tab, author string) (*Revision, error)
+	RmTab(tab *Tab) error
+	GetTabs() ([]Tab, error)
+	GetUserTabs(user *User) ([]Tab, error)
+	GetPublicTabs() ([]Tab, error)
+	GetUserTabsPage(owner string, page Page) (TabPage, error)
+	GetPublicTabsPage(page Page) (TabPage, error)
+	Search(query SearchQuery) ([]SearchResult, error)
+
+	TrashTab(tab *Tab, by string) error
+	RestoreTab(tab *Tab, newOwner string) error
+	GetTrash(owner string) ([]Tab, error)
+	GetAllTrash() ([]Tab, error)
+
+	TransferTab(id uuid.UUID, to string, by string) (*Tab, error)
+	OfferTab(id uuid.UUID, to string, by string) (*Transfer, error)
+	GetTransfer(id uuid.UUID) (*Transfer, error)
+	AcceptTransfer(id uuid.UUID, name string) (*Tab, error)
+	CancelTransfer(id uuid.UUID, by string) error
+	GetTransfers(name string) (incoming []Transfer, outgoing []Transfer, err error)
+	GetAudit(id uuid.UUID) ([]AuditEntry, error)
+
+	ForkTab(source uuid.UUID, owner string) (*Tab, error)
+	GetForks(source uuid.UUID) ([]Tab, error)
+
+	CreateCollection(owner string, name string, parent *uuid.UUID) (*Collection, error)
+	GetCollection(id uuid.UUID) (*Collection, error)
+	GetCollections(name string) (own []Collection, shared []Collection, err error)
+	RenameCollection(id uuid.UUID, name string) (*Collection, error)
+	MoveCollection(id uuid.UUID, parent *uuid.UUID) (*Collection, error)
+	ShareCollection(id uuid.UUID, public bool, with []string) (*Collection, error)
+	ReorderCollections(owner string, parent *uuid.UUID, ids []uuid.UUID) error
+	DeleteCollection(id uuid.UUID) error
+	MoveTabs(owner string, tabs []uuid.UUID, from *uuid.UUID, to *uuid.UUID) error
+	GetCollectionTabsPage(id uuid.UUID, all bool, page Page) (TabPage, error)
+
+	AddTags(id uuid.UUID, tags []string) (*Tab, error)
+	RemoveTags(id uuid.UUID, tags []string) (*Tab, error)
+	SuggestTags(text string, user *User, limit int) ([]TagCount, error)
+	GetTaggedTabsPage(owner string, tag string, page Page) (TabPage, error)
+
+	StarTab(id uuid.UUID, name string) (int, error)
+	UnstarTab(id uuid.UUID, name string) (int, error)
+	WithStars(tabs []Tab) ([]StarredTab, error)
+	GetFavoritesPage(name string, page Page) (StarredTabPage, error)
+
+	GetRevisions(tab uuid.UUID) ([]Revision, error)
+	GetRevision(tab uuid.UUID, id string) (*Revision, error)
+	RestoreRevision(tab *Tab, id string, author string) (*Revision, error)
+}
+
+// Store implements UserStore and TabStore on top of any Backend.
 type Store struct {
-	db *badger.DB
+	db Backend
+	RevisionPolicy RevisionPolicy
+	Quota Quota // for users without a quota of their own
+	maintenance *maintenance
 }
 
+// NewStore opens the backend at location, see OpenBackend.
 func NewStore(location string) (*Store, error) {
-	db, err := badger.Open(badger.DefaultOptions(location))
+	db, err := OpenBackend(location)
 	if err != nil {
 		return nil, err
 	}
+	return NewStoreWithBackend(db), nil
+}
+
+// NewStoreWithBackend starts collecting the garbage of the backend in the
+// background, until the store is closed.
+func NewStoreWithBackend(db Backend) *Store {
 	return &Store{
 		db,
-	}, nil
+		DefaultRevisionPolicy,
+		DefaultQuota,
+		startMaintenance(db, maintenancePolicy()),
+	}
 }
 
 func (s Store) Close() {
+	s.maintenance.stop()
 	err := s.db.Close()
 	if err != nil {
 		log.Fatalf("%v", err)
@@ -39,55 +124,134 @@ func (s Store) Close() {
 }
 
 type User struct {
+	Schema   int
 	Name     string
 	Password []byte
 	Admin    bool
 	Tabs  []uuid.UUID
+	Usage *Usage `json:",omitempty"` // nil for users from before usage was tracked
+	Quota *Quota `json:",omitempty"` // overrides the default quota
+}
+
+func (u *User) setSchema(version int) {
+	u.Schema = version
 }
 
 type Tab struct {
+	Schema int
 	Id    uuid.UUID
 	Owner string
 	Public bool // Visible on home page?
 	Contents string // JSON encoded tab contents
+	TrashedAt *time.Time `json:",omitempty"` // Set while the tab is in the trash
+	TrashedBy string `json:",omitempty"`
+	CreatedAt time.Time
+	UpdatedAt time.Time // Last change to the contents or visibility
+	LastEditedBy string
+	ContentSize int // Length of Contents in bytes
+	ForkedFrom *uuid.UUID `json:",omitempty"` // The tab this one is a copy of
+	ForkedRevision string `json:",omitempty"` // The revision of ForkedFrom that was copied, if it had any
+	Collections []uuid.UUID `json:",omitempty"` // The collections of the owner the tab is in
+	Tags []string `json:",omitempty"` // Lower case, see normalizeTag
 }
 
-func (s *Store) CreateUser(user User) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&user)
-		if err != nil {
-			return err
+// touchTab records a change to the tab made by editor.
+func touchTab(tab *Tab, editor string, now time.Time) {
+	tab.UpdatedAt = now
+	tab.LastEditedBy = editor
+	tab.ContentSize = len(tab.Contents)
+}
+
+func (t *Tab) setSchema(version int) {
+	t.Schema = version
+}
+
+func getJSON(txn Txn, key []byte, v interface{}) error {
+	val, err := txn.Get(key)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(key, val, v)
+}
+
+// record is implemented by everything that is stored under
+// a prefix with migrations, so it can be stamped with its schema version.
+type record interface {
+	setSchema(version int)
+}
+
+func setJSON(txn Txn, key []byte, v interface{}) error {
+	if r, ok := v.(record); ok {
+		if p, ok := recordPrefix(key); ok {
+			r.setSchema(schemaVersion(p))
 		}
+	}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(key, compressValue(b.Bytes()))
+}
+
+// putTab writes a tab together with its secondary indexes.
+func putTab(txn Txn, tab *Tab) error {
+	err := setJSON(txn, prefix(tabPrefix, tab.Id.String()), tab)
+	if err != nil {
+		return err
+	}
+
+	return setTabIndexes(txn, tab, tab.UpdatedAt)
+}
+
+// deleteTab removes a tab with everything that refers to it, except the
+// owner's list of tabs.
+func deleteTab(txn Txn, id uuid.UUID) error {
+	err := rmTabIndexes(txn, id)
+	if err != nil {
+		return err
+	}
+
+	err = rmRevisions(txn, id)
+	if err != nil {
+		return err
+	}
+
+	err = txn.Delete(transferKey(id))
+	if err != nil {
+		return err
+	}
+
+	err = rmTabStars(txn, id)
+	if err != nil {
+		return err
+	}
+
+	return txn.Delete(prefix(tabPrefix, id.String()))
+}
+
+func (s *Store) CreateUser(user User) error {
+	return s.db.Update(func(txn Txn) error {
+		return setJSON(txn, prefix(userPrefix, user.Name), &user)
 	})
 }
 
 func (s *Store) GetUser(name string) (User, error) {
 	var res User
-	return res, s.db.View(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, name))
-		if err != nil {
-			return err
-		}
-		return entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res)
-		})
+	return res, s.db.View(func(txn Txn) error {
+		return getJSON(txn, prefix(userPrefix, name), &res)
 	})
 }
 
 func (s *Store) CountUsers() (int, error) {
 	res := 0
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(userPrefix)); it.ValidForPrefix([]byte(userPrefix)); it.Next() {
+	return res, s.db.View(func(txn Txn) error {
+		return txn.IterateKeys([]byte(userPrefix), func(_ []byte) error {
 			res += 1
-		}
-
-		it.Close()
-
-		return nil
+			return nil
+		})
 	})
 }
 
@@ -108,292 +272,241 @@ func (s *Store) CountAdminUsers() (int, error) {
 }
 
 func (s Store) UpdateUser(user *User) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&user)
-		if err != nil {
-			return err
-		}
-
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+	return s.db.Update(func(txn Txn) error {
+		return setJSON(txn, prefix(userPrefix, user.Name), user)
 	})
 }
 
 func (s Store) GetTab(id uuid.UUID) (*Tab, error) {
 	var res *Tab
-	return res, s.db.View(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(tabPrefix, id.String()))
-		if err == badger.ErrKeyNotFound {
+	return res, s.db.View(func(txn Txn) error {
+		err := getJSON(txn, prefix(tabPrefix, id.String()), &res)
+		if err == ErrNotFound {
 			return nil
 		}
-		if err != nil {
-			return err
-		}
-		return entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res)
-		})
-	})
-}
-
-func (s Store) CreateTab(tab Tab) error {
-	err := s.AddTabToUser(tab.Owner, tab.Id)
-	if err != nil {
 		return err
-	}
-
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&tab)
-		if err != nil {
-			return err
-		}
-
-		return txn.Set(prefix(tabPrefix, tab.Id.String()), b.Bytes())
 	})
 }
 
-func (s Store) AddTabToUser(owner string, id uuid.UUID) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, owner))
-		if err != nil {
-			return err
-		}
+// CreateTab stores a new tab and adds it to its owner in one transaction.
+// The creation time and last editor are filled in. It fails with ErrTabQuota
+// or ErrByteQuota when the owner has no room for the tab.
+func (s Store) CreateTab(tab *Tab) error {
+	now := time.Now()
+	tab.CreatedAt = now
+	touchTab(tab, tab.Owner, now)
 
-		var user User
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
+	return s.db.Update(func(txn Txn) error {
+		err := addTabToUser(txn, tab.Owner, tab.Id, tab.ContentSize)
 		if err != nil {
 			return err
 		}
 
-		user.Tabs = append(user.Tabs, id)
-
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+		err = s.checkQuota(txn, tab.Owner)
 		if err != nil {
 			return err
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		return putTab(txn, tab)
 	})
 }
 
-func (s Store) RmTabFromUser(owner string, id uuid.UUID) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, owner))
+func (s Store) AddTabToUser(owner string, id uuid.UUID) error {
+	return s.db.Update(func(txn Txn) error {
+		size, err := tabSize(txn, id)
 		if err != nil {
 			return err
 		}
+		return addTabToUser(txn, owner, id, size)
+	})
+}
 
-		var user User
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
-		if err != nil {
-			return err
-		}
+// addTabToUser adds a tab of the given size to the tabs and usage of a user.
+func addTabToUser(txn Txn, owner string, id uuid.UUID, size int) error {
+	var user User
+	err := getJSON(txn, prefix(userPrefix, owner), &user)
+	if err != nil {
+		return err
+	}
 
-		var toRemove []int
-		for i, a := range user.Tabs {
-			if a == id {
-				toRemove = append(toRemove, i)
-			}
-		}
+	err = addUsage(txn, &user, 1, size)
+	if err != nil {
+		return err
+	}
+	user.Tabs = append(user.Tabs, id)
 
-		for _, r := range toRemove {
-			user.Tabs = append(user.Tabs[:r], user.Tabs[r+1:]...)
-		}
+	return setJSON(txn, prefix(userPrefix, user.Name), &user)
+}
 
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+func (s Store) RmTabFromUser(owner string, id uuid.UUID) error {
+	return s.db.Update(func(txn Txn) error {
+		size, err := tabSize(txn, id)
 		if err != nil {
 			return err
 		}
-
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		return rmTabFromUser(txn, owner, id, size)
 	})
 }
 
-func (s Store) GetUserTabs(user *User) ([]Tab, error) {
-	if user.Tabs == nil {
-		return []Tab{}, nil
+func rmTabFromUser(txn Txn, owner string, id uuid.UUID, size int) error {
+	var user User
+	err := getJSON(txn, prefix(userPrefix, owner), &user)
+	if err != nil {
+		return err
 	}
 
-	res := make([]Tab, len(user.Tabs))
+	// count the usage while the tab is still listed
+	usage, err := userUsage(txn, &user)
+	if err != nil {
+		return err
+	}
 
-	return res, s.db.View(func(txn *badger.Txn) error {
-		for i, id := range user.Tabs {
-			entry, err := txn.Get(prefix(tabPrefix, id.String()))
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-			err = entry.Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res[i])
-			})
-			if err != nil {
-				return err
-			}
+	tabs := make([]uuid.UUID, 0, len(user.Tabs))
+	for _, a := range user.Tabs {
+		if a != id {
+			tabs = append(tabs, a)
+		} else {
+			usage.Tabs -= 1
+			usage.Bytes -= size
 		}
-		return nil
-	})
+	}
+	user.Tabs = tabs
+	user.Usage = &usage
+
+	return setJSON(txn, prefix(userPrefix, user.Name), &user)
 }
 
-func (s Store) RmTab(tab *Tab) error {
-	if err := s.RmTabFromUser(tab.Owner, tab.Id); err != nil {
+func (s Store) GetUserTabs(user *User) ([]Tab, error) {
+	res := []Tab{}
+	return res, s.db.View(func(txn Txn) error {
+		tabs, err := indexedTabs(txn, ownerIndexPrefixFor(user.Name), false)
+		res = append(res, tabs...)
 		return err
-	}
+	})
+}
 
-	return s.db.Update(func(txn *badger.Txn) error {
+// RmTab deletes a tab and removes it from its owner in one transaction.
+func (s Store) RmTab(tab *Tab) error {
+	return s.db.Update(func(txn Txn) error {
+		err := rmTabFromUser(txn, tab.Owner, tab.Id, tab.ContentSize)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
 
-		return txn.Delete(prefix(tabPrefix, tab.Id.String()))
+		return deleteTab(txn, tab.Id)
 	})
 }
 
 func (s Store) GetUsers() ([]User, error) {
 	var res []User
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(userPrefix)); it.ValidForPrefix([]byte(userPrefix)); it.Next() {
-
+	return res, s.db.View(func(txn Txn) error {
+		return txn.Iterate([]byte(userPrefix), false, func(key []byte, val []byte) error {
 			var user User
-			err := it.Item().Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-			})
-
+			err := decodeJSON(key, val, &user)
 			if err != nil {
 				return err
 			}
 
 			res = append(res, user)
-		}
-
-		it.Close()
-
-		return nil
+			return nil
+		})
 	})
 }
 
 func (s Store) GetTabs() ([]Tab, error) {
 	var res []Tab
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(tabPrefix)); it.ValidForPrefix([]byte(tabPrefix)); it.Next() {
-
+	return res, s.db.View(func(txn Txn) error {
+		return txn.Iterate([]byte(tabPrefix), false, func(key []byte, val []byte) error {
 			var tab Tab
-			err := it.Item().Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&tab)
-			})
-
+			err := decodeJSON(key, val, &tab)
 			if err != nil {
 				return err
 			}
 
 			res = append(res, tab)
-		}
-
-		it.Close()
-
-		return nil
+			return nil
+		})
 	})
 }
 
+// GetPublicTabs returns all public tabs, most recently updated first.
 func (s Store) GetPublicTabs() ([]Tab, error) {
 	var res []Tab
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(tabPrefix)); it.ValidForPrefix([]byte(tabPrefix)); it.Next() {
-
-			var tab Tab
-			err := it.Item().Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&tab)
-			})
-
-			if !tab.Public {
-				continue
-			}
-
-			if err != nil {
-				return err
-			}
-
-			res = append(res, tab)
-		}
-
-		it.Close()
-
-		return nil
+	return res, s.db.View(func(txn Txn) error {
+		var err error
+		res, err = indexedTabs(txn, sortIndexPrefixFor(publicScope, SortUpdated), true)
+		return err
 	})
 }
 
+// RmUser deletes a user and moves all their tabs to the trash.
 func (s Store) RmUser(name string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
+	return s.db.Update(func(txn Txn) error {
 		var user User
-		entry, err := txn.Get(prefix(userPrefix, name))
-		if err != nil {
-			return err
-		}
-
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
+		err := getJSON(txn, prefix(userPrefix, name), &user)
 		if err != nil {
 			return err
 		}
 
+		now := time.Now()
 		for _, id := range user.Tabs {
+			var tab Tab
+			err = getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+			if err == ErrNotFound {
+				continue
+			}
 			if err != nil {
 				return err
 			}
-			err = txn.Delete(prefix(tabPrefix, id.String()))
+
+			if tab.TrashedAt == nil {
+				tab.TrashedAt = &now
+				tab.TrashedBy = name
+			}
+			err = putTab(txn, &tab)
 			if err != nil {
 				return err
 			}
 		}
 
-		return txn.Delete(prefix(userPrefix, name))
-	})
-}
-
-func (s Store) SetAdmin(name string, value bool) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var user User
-		entry, err := txn.Get(prefix(userPrefix, name))
+		err = rmUserCollections(txn, name)
 		if err != nil {
 			return err
 		}
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
+
+		err = rmUserStars(txn, name)
 		if err != nil {
 			return err
 		}
 
-		user.Admin = value
+		return txn.Delete(prefix(userPrefix, name))
+	})
+}
 
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+func (s Store) SetAdmin(name string, value bool) error {
+	return s.db.Update(func(txn Txn) error {
+		var user User
+		err := getJSON(txn, prefix(userPrefix, name), &user)
 		if err != nil {
 			return err
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		user.Admin = value
+
+		return setJSON(txn, prefix(userPrefix, user.Name), &user)
 	})
 }
 
+// SetTab stores a changed tab. LastEditedBy has to be set by the caller.
+// Growing a tab beyond the owner's quota fails with ErrByteQuota.
 func (s Store) SetTab(id uuid.UUID, tab *Tab) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&tab)
+	touchTab(tab, tab.LastEditedBy, time.Now())
+
+	return s.db.Update(func(txn Txn) error {
+		err := s.resizeTab(txn, tab)
 		if err != nil {
 			return err
 		}
-
-		return txn.Set(prefix(tabPrefix, id.String()), b.Bytes())
+		return putTab(txn, tab)
 	})
 }
-
-
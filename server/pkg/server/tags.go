@@ -0,0 +1,287 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tags are indexed twice: per owner for the owner's own listings, and for
+// the public tabs. idx_tagown_<owner>\x00<tag>\x00<id> and
+// idx_tagpub_<tag>\x00<id> are the inverted index used for autocompletion,
+// and tagged listings have sort indexes of their own, see tagOwnerScope.
+// In an encrypted store the tags in the owner index are blinded, as they
+// include those of private tabs, see EncryptedBackend.
+const tagOwnerIndexPrefix = indexPrefix + "tagown_"
+const tagPublicIndexPrefix = indexPrefix + "tagpub_"
+
+const MaxTags = 20
+const MaxTagLength = 40
+
+const DefaultTagSuggestions = 10
+const MaxTagSuggestions = 100
+
+var ErrInvalidTag = fmt.Errorf("tags must be between 1 and %d characters", MaxTagLength)
+var ErrTooManyTags = fmt.Errorf("a tab can have at most %d tags", MaxTags)
+var ErrTagAndCollection = errors.New("cannot filter by tag and collection at once")
+
+// normalizeTag makes tags which only differ in case or spacing the same.
+func normalizeTag(tag string) (string, error) {
+	res := strings.ToLower(strings.Join(strings.Fields(tag), " "))
+	if res == "" || len(res) > MaxTagLength || strings.ContainsRune(res, 0) {
+		return "", ErrInvalidTag
+	}
+	return res, nil
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	var res []string
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tag)
+	}
+	return res, nil
+}
+
+func tagOwnerIndexPrefixFor(owner string) []byte {
+	return prefix(tagOwnerIndexPrefix, owner+"\x00")
+}
+
+func tagPublicIndexPrefixFor(tag string) []byte {
+	return prefix(tagPublicIndexPrefix, tag+"\x00")
+}
+
+func tagOwnerScope(owner string, tag string) string {
+	return "tagown_" + owner + "\x00" + tag
+}
+
+func tagPublicScope(tag string) string {
+	return "tagpub_" + tag
+}
+
+func tagIndexKeys(txn Txn, tab *Tab, updated time.Time) [][]byte {
+	var keys [][]byte
+	for _, tag := range tab.Tags {
+		owned, _ := indexText(txn, tag)
+		key := append(tagOwnerIndexPrefixFor(tab.Owner), owned+"\x00"+tab.Id.String()...)
+		keys = append(keys, key)
+		keys = append(keys, sortIndexKeys(tagOwnerScope(tab.Owner, owned), tab, updated)...)
+		if tab.Public {
+			keys = append(keys, append(tagPublicIndexPrefixFor(tag), tab.Id.String()...))
+			keys = append(keys, sortIndexKeys(tagPublicScope(tag), tab, updated)...)
+		}
+	}
+	return keys
+}
+
+// changeTags applies change to the tags of a stored tab.
+func (s Store) changeTags(id uuid.UUID, change func(tags []string) []string) (*Tab, error) {
+	var res *Tab
+	err := s.db.Update(func(txn Txn) error {
+		var tab Tab
+		err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+		if err != nil {
+			return err
+		}
+
+		tab.Tags = change(tab.Tags)
+		if len(tab.Tags) > MaxTags {
+			return ErrTooManyTags
+		}
+
+		res = &tab
+		return putTab(txn, &tab)
+	})
+	return res, err
+}
+
+// AddTags tags a tab. Tags are lower cased, and tags it already has are
+// left alone.
+func (s Store) AddTags(id uuid.UUID, tags []string) (*Tab, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.changeTags(id, func(old []string) []string {
+		res := old
+		for _, tag := range tags {
+			if !containsTag(res, tag) {
+				res = append(res, tag)
+			}
+		}
+		return res
+	})
+}
+
+func (s Store) RemoveTags(id uuid.UUID, tags []string) (*Tab, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.changeTags(id, func(old []string) []string {
+		var res []string
+		for _, tag := range old {
+			if !containsTag(tags, tag) {
+				res = append(res, tag)
+			}
+		}
+		return res
+	})
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// SuggestTags completes a tag from the tags of the public tabs and those of
+// user, which may be nil. The most used tags come first. The tags of user
+// are read from their tabs when the owner index is blinded.
+func (s Store) SuggestTags(text string, user *User, limit int) ([]TagCount, error) {
+	if limit <= 0 {
+		limit = DefaultTagSuggestions
+	}
+	if limit > MaxTagSuggestions {
+		limit = MaxTagSuggestions
+	}
+
+	// a tag that is still being typed, so without normalizeTag's checks
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+
+	tabs := map[string]map[string]bool{}
+	add := func(tag string, id string) {
+		if tabs[tag] == nil {
+			tabs[tag] = map[string]bool{}
+		}
+		tabs[tag][id] = true
+	}
+	count := func(p []byte) func(key []byte) error {
+		return func(key []byte) error {
+			rest := string(key[len(p)-len(text):])
+			if len(rest) < 37 {
+				return fmt.Errorf("invalid tag index key %q", key)
+			}
+			add(rest[:len(rest)-37], rest[len(rest)-36:])
+			return nil
+		}
+	}
+
+	err := s.db.View(func(txn Txn) error {
+		p := prefix(tagPublicIndexPrefix, text)
+		if err := txn.IterateKeys(p, count(p)); err != nil {
+			return err
+		}
+		if user == nil {
+			return nil
+		}
+
+		if _, blinded := indexText(txn, text); !blinded {
+			p = append(tagOwnerIndexPrefixFor(user.Name), text...)
+			return txn.IterateKeys(p, count(p))
+		}
+
+		var ids []string
+		err := txn.IterateKeys(ownerIndexPrefixFor(user.Name), func(key []byte) error {
+			ids = append(ids, string(key[len(key)-36:]))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			var tab Tab
+			err := getJSON(txn, prefix(tabPrefix, id), &tab)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, tag := range tab.Tags {
+				if strings.HasPrefix(tag, text) {
+					add(tag, id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := []TagCount{}
+	for tag, ids := range tabs {
+		res = append(res, TagCount{tag, len(ids)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Tag < res[j].Tag
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// GetTaggedTabsPage lists the tabs of owner with a tag, or the public tabs
+// with the tag when owner is empty. The default order is that of
+// GetUserTabsPage and GetPublicTabsPage.
+func (s Store) GetTaggedTabsPage(owner string, tag string, page Page) (TabPage, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return TabPage{}, err
+	}
+
+	if owner == "" {
+		if page.Sort == "" {
+			page.Sort, page.Desc = SortUpdated, true
+		}
+		if !validTabSort(page.Sort) {
+			return TabPage{}, ErrInvalidSort
+		}
+		return s.tabPage(sortIndexPrefixFor(tagPublicScope(tag), page.Sort), page)
+	}
+
+	tag, _ = indexText(s.db, tag)
+	if page.Sort == "" {
+		return s.tabPage(append(tagOwnerIndexPrefixFor(owner), tag+"\x00"...), page)
+	}
+	if !validTabSort(page.Sort) {
+		return TabPage{}, ErrInvalidSort
+	}
+	return s.tabPage(sortIndexPrefixFor(tagOwnerScope(owner, tag), page.Sort), page)
+}
+
+// writeTagError answers a request with invalid tags, and reports whether
+// err was such an error.
+func writeTagError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case ErrInvalidTag, ErrTooManyTags, ErrTagAndCollection:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		return false
+	}
+
+	_, _ = w.Write([]byte(err.Error()))
+	return true
+}
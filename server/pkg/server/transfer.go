@@ -0,0 +1,317 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"time"
+)
+
+// A pending transfer is stored under the id of its tab, so a tab is offered
+// to at most one user at a time. The audit trail is stored per tab, sorted
+// by time, and outlives the tab so it can still be consulted after a purge.
+const transferPrefix = "transfer_"
+const auditPrefix = "audit_"
+
+var ErrSameOwner = errors.New("tab already belongs to this user")
+var ErrUnknownRecipient = errors.New("recipient does not exist")
+var ErrTabTrashed = errors.New("tab is in the trash")
+var ErrNoTransfer = errors.New("no pending transfer for this tab")
+
+// Actions in the audit trail.
+const (
+	AuditOffered     = "offered"
+	AuditTransferred = "transferred"
+	AuditDeclined    = "declined"
+	AuditCancelled   = "cancelled"
+)
+
+// Transfer is an offer of a tab to another user, waiting for them to accept.
+type Transfer struct {
+	Tab       uuid.UUID
+	From      string
+	To        string
+	By        string // the owner or an admin
+	CreatedAt time.Time
+}
+
+// AuditEntry records a change of, or an attempt to change, the owner of a tab.
+type AuditEntry struct {
+	Time   time.Time
+	Action string
+	Tab    uuid.UUID
+	From   string
+	To     string
+	By     string
+}
+
+func transferKey(id uuid.UUID) []byte {
+	return prefix(transferPrefix, id.String())
+}
+
+func auditTabPrefix(id uuid.UUID) []byte {
+	return prefix(auditPrefix, id.String()+"_")
+}
+
+func audit(txn Txn, entry AuditEntry) error {
+	key := append(auditTabPrefix(entry.Tab), indexTime(entry.Time)...)
+	return setJSON(txn, key, &entry)
+}
+
+// transferableTab loads a tab which may be given to the user to.
+func transferableTab(txn Txn, id uuid.UUID, to string) (*Tab, error) {
+	var tab Tab
+	err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+	if err != nil {
+		return nil, err
+	}
+	if tab.TrashedAt != nil {
+		return nil, ErrTabTrashed
+	}
+	if tab.Owner == to {
+		return nil, ErrSameOwner
+	}
+
+	err = getJSON(txn, prefix(userPrefix, to), &User{})
+	if err == ErrNotFound {
+		return nil, ErrUnknownRecipient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tab, nil
+}
+
+// moveTab gives a tab to another user, cancelling a pending transfer.
+func (s Store) moveTab(txn Txn, tab *Tab, to string) error {
+	err := rmTabFromUser(txn, tab.Owner, tab.Id, tab.ContentSize)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	err = addTabToUser(txn, to, tab.Id, tab.ContentSize)
+	if err != nil {
+		return err
+	}
+	err = s.checkQuota(txn, to)
+	if err != nil {
+		return err
+	}
+
+	err = txn.Delete(transferKey(tab.Id))
+	if err != nil {
+		return err
+	}
+
+	// collections belong to the previous owner
+	tab.Owner = to
+	tab.Collections = nil
+	return putTab(txn, tab)
+}
+
+// TransferTab makes to the owner of a tab right away. It fails with
+// ErrTabQuota or ErrByteQuota when the recipient has no room for the tab.
+func (s Store) TransferTab(id uuid.UUID, to string, by string) (*Tab, error) {
+	var res *Tab
+	err := s.db.Update(func(txn Txn) error {
+		tab, err := transferableTab(txn, id, to)
+		if err != nil {
+			return err
+		}
+
+		from := tab.Owner
+		if err := s.moveTab(txn, tab, to); err != nil {
+			return err
+		}
+
+		res = tab
+		return audit(txn, AuditEntry{
+			Time:   time.Now(),
+			Action: AuditTransferred,
+			Tab:    id,
+			From:   from,
+			To:     to,
+			By:     by,
+		})
+	})
+	return res, err
+}
+
+// OfferTab offers a tab to another user, who becomes the owner once they
+// accept it. An earlier offer of the same tab is replaced.
+func (s Store) OfferTab(id uuid.UUID, to string, by string) (*Transfer, error) {
+	var res *Transfer
+	err := s.db.Update(func(txn Txn) error {
+		tab, err := transferableTab(txn, id, to)
+		if err != nil {
+			return err
+		}
+
+		res = &Transfer{
+			Tab:       id,
+			From:      tab.Owner,
+			To:        to,
+			By:        by,
+			CreatedAt: time.Now(),
+		}
+		if err := setJSON(txn, transferKey(id), res); err != nil {
+			return err
+		}
+
+		return audit(txn, AuditEntry{
+			Time:   res.CreatedAt,
+			Action: AuditOffered,
+			Tab:    id,
+			From:   res.From,
+			To:     to,
+			By:     by,
+		})
+	})
+	return res, err
+}
+
+func getTransfer(txn Txn, id uuid.UUID) (*Transfer, error) {
+	var res Transfer
+	err := getJSON(txn, transferKey(id), &res)
+	if err == ErrNotFound {
+		return nil, ErrNoTransfer
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetTransfer returns the pending transfer of a tab, or ErrNoTransfer.
+func (s Store) GetTransfer(id uuid.UUID) (*Transfer, error) {
+	var res *Transfer
+	err := s.db.View(func(txn Txn) error {
+		var err error
+		res, err = getTransfer(txn, id)
+		return err
+	})
+	return res, err
+}
+
+// AcceptTransfer makes the recipient of a pending transfer the owner of
+// the tab.
+func (s Store) AcceptTransfer(id uuid.UUID, name string) (*Tab, error) {
+	var res *Tab
+	err := s.db.Update(func(txn Txn) error {
+		transfer, err := getTransfer(txn, id)
+		if err != nil {
+			return err
+		}
+		if transfer.To != name {
+			return ErrNoTransfer
+		}
+
+		tab, err := transferableTab(txn, id, name)
+		if err != nil {
+			return err
+		}
+		// the offer was made by a previous owner
+		if tab.Owner != transfer.From {
+			return ErrNoTransfer
+		}
+
+		if err := s.moveTab(txn, tab, name); err != nil {
+			return err
+		}
+
+		res = tab
+		return audit(txn, AuditEntry{
+			Time:   time.Now(),
+			Action: AuditTransferred,
+			Tab:    id,
+			From:   transfer.From,
+			To:     name,
+			By:     name,
+		})
+	})
+	return res, err
+}
+
+// CancelTransfer withdraws a pending transfer. When by is the recipient, the
+// transfer is recorded as declined.
+func (s Store) CancelTransfer(id uuid.UUID, by string) error {
+	return s.db.Update(func(txn Txn) error {
+		transfer, err := getTransfer(txn, id)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Delete(transferKey(id)); err != nil {
+			return err
+		}
+
+		action := AuditCancelled
+		if by == transfer.To {
+			action = AuditDeclined
+		}
+		return audit(txn, AuditEntry{
+			Time:   time.Now(),
+			Action: action,
+			Tab:    id,
+			From:   transfer.From,
+			To:     transfer.To,
+			By:     by,
+		})
+	})
+}
+
+// GetTransfers lists the pending transfers to and from a user.
+func (s Store) GetTransfers(name string) (incoming []Transfer, outgoing []Transfer, err error) {
+	incoming = []Transfer{}
+	outgoing = []Transfer{}
+	err = s.db.View(func(txn Txn) error {
+		return txn.Iterate([]byte(transferPrefix), false, func(key []byte, val []byte) error {
+			var transfer Transfer
+			if err := decodeJSON(key, val, &transfer); err != nil {
+				return err
+			}
+
+			if transfer.To == name {
+				incoming = append(incoming, transfer)
+			}
+			if transfer.From == name {
+				outgoing = append(outgoing, transfer)
+			}
+			return nil
+		})
+	})
+	return incoming, outgoing, err
+}
+
+// GetAudit returns the audit trail of a tab, oldest first.
+func (s Store) GetAudit(id uuid.UUID) ([]AuditEntry, error) {
+	res := []AuditEntry{}
+	err := s.db.View(func(txn Txn) error {
+		return txn.Iterate(auditTabPrefix(id), false, func(key []byte, val []byte) error {
+			var entry AuditEntry
+			if err := decodeJSON(key, val, &entry); err != nil {
+				return err
+			}
+			res = append(res, entry)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// writeTransferError answers a request for a transfer which can't be made,
+// and reports whether err was such an error.
+func writeTransferError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case ErrSameOwner, ErrUnknownRecipient, ErrTabTrashed:
+		w.WriteHeader(http.StatusBadRequest)
+	case ErrNoTransfer, ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		return writeQuotaError(w, err)
+	}
+
+	_, _ = w.Write([]byte(err.Error()))
+	return true
+}
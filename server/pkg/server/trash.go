@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"time"
+)
+
+var ErrNotTrashed = errors.New("tab is not in the trash")
+
+const DefaultTrashRetention = 30 * 24 * time.Hour
+const janitorInterval = time.Hour
+
+func trashRetention() time.Duration {
+	env := os.Getenv("TRASH_RETENTION")
+	if env == "" {
+		return DefaultTrashRetention
+	}
+
+	res, err := time.ParseDuration(env)
+	if err != nil {
+		log.Printf("invalid value %q for TRASH_RETENTION, using %v", env, DefaultTrashRetention)
+		return DefaultTrashRetention
+	}
+
+	return res
+}
+
+// TrashTab moves a tab to the trash. It disappears from all listings
+// except the trash until it is restored or purged.
+func (s Store) TrashTab(tab *Tab, by string) error {
+	now := time.Now()
+	tab.TrashedAt = &now
+	tab.TrashedBy = by
+
+	return s.db.Update(func(txn Txn) error {
+		return putTab(txn, tab)
+	})
+}
+
+// RestoreTab takes a tab out of the trash. Tabs of users that have since been
+// deleted are given to newOwner, which fails with ErrTabQuota or
+// ErrByteQuota when newOwner has no room for them.
+func (s Store) RestoreTab(tab *Tab, newOwner string) error {
+	if tab.TrashedAt == nil {
+		return ErrNotTrashed
+	}
+
+	return s.db.Update(func(txn Txn) error {
+		err := getJSON(txn, prefix(userPrefix, tab.Owner), &User{})
+		if err == ErrNotFound {
+			tab.Owner = newOwner
+			tab.Collections = nil
+			err = addTabToUser(txn, newOwner, tab.Id, tab.ContentSize)
+			if err == nil {
+				err = s.checkQuota(txn, newOwner)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		tab.TrashedAt = nil
+		tab.TrashedBy = ""
+
+		return putTab(txn, tab)
+	})
+}
+
+// GetTrash lists the trashed tabs of a user.
+func (s Store) GetTrash(owner string) ([]Tab, error) {
+	res := []Tab{}
+	return res, s.db.View(func(txn Txn) error {
+		tabs, err := indexedTabs(txn, trashIndexPrefixFor(owner), false)
+		res = append(res, tabs...)
+		return err
+	})
+}
+
+// GetAllTrash lists every trashed tab, the longest trashed first.
+func (s Store) GetAllTrash() ([]Tab, error) {
+	res := []Tab{}
+	return res, s.db.View(func(txn Txn) error {
+		tabs, err := indexedTabs(txn, []byte(purgeIndexPrefix), false)
+		res = append(res, tabs...)
+		return err
+	})
+}
+
+// PurgeTrash permanently deletes all tabs trashed before the given time.
+func (s Store) PurgeTrash(before time.Time) (int, error) {
+	var ids []uuid.UUID
+	limit := purgeIndexKey(before, uuid.Nil)
+	err := s.db.View(func(txn Txn) error {
+		err := txn.IterateKeys([]byte(purgeIndexPrefix), func(key []byte) error {
+			if string(key) >= string(limit) {
+				return errStopIteration
+			}
+
+			id, err := indexedTabId(key)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+		if err == errStopIteration {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		err := s.db.Update(func(txn Txn) error {
+			var tab Tab
+			err := getJSON(txn, prefix(tabPrefix, id.String()), &tab)
+			if err == ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// restored in the meantime
+			if tab.TrashedAt == nil || !tab.TrashedAt.Before(before) {
+				return nil
+			}
+
+			err = rmTabFromUser(txn, tab.Owner, tab.Id, tab.ContentSize)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+
+			purged += 1
+			return deleteTab(txn, tab.Id)
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// StartJanitor purges tabs which have been in the trash for longer than
+// retention, once every janitorInterval. The returned function stops the
+// janitor and waits for a running purge to finish.
+func (s Store) StartJanitor(retention time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(janitorInterval)
+
+	purge := func() {
+		n, err := s.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("purging trash: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d tabs from the trash", n)
+		}
+	}
+
+	go func() {
+		purge()
+		for {
+			select {
+			case <-ticker.C:
+				purge()
+			case <-done:
+				ticker.Stop()
+				close(stopped)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,486 @@
+package tabdata
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultLineWidth = 80
+
+// MinLineWidth keeps narrow widths from putting every measure on its own
+// line, which they do anyway when a measure is wider than the line.
+const MinLineWidth = 20
+
+// ASCII renders the tab as plain text tablature:
+//
+//	e|--0--3--|--12--|
+//	B|--1-----|--3---|
+//
+// Frets are printed relative to the capo, like the editor shows them, and
+// lines are wrapped between measures to fit in width columns.
+func (t *TabData) ASCII(width int) string {
+	if width < MinLineWidth {
+		width = MinLineWidth
+	}
+
+	var b strings.Builder
+	if t.Name != "" {
+		b.WriteString(t.Name + "\n")
+	}
+	if capo := t.CapoFret(); capo > 0 {
+		fmt.Fprintf(&b, "Capo on fret %d\n", capo)
+	}
+
+	for i, section := range t.Sections {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+
+		switch {
+		case section.Name != "":
+			fmt.Fprintf(&b, "[%s]\n", section.Name)
+		case len(t.Sections) > 1:
+			fmt.Fprintf(&b, "[Section %d]\n", i+1)
+		}
+
+		section.writeASCII(&b, width, t.CapoFret())
+	}
+
+	return b.String()
+}
+
+func (s *SectionData) writeASCII(b *strings.Builder, width int, capo int) {
+	lines := len(s.StringNames)
+	for _, m := range s.Measures {
+		if len(m.Strings) > lines && len(s.StringNames) == 0 {
+			lines = len(m.Strings)
+		}
+	}
+	if lines == 0 {
+		return
+	}
+
+	names := make([]string, lines)
+	nameWidth := 0
+	for i := range names {
+		if i < len(s.StringNames) {
+			names[i] = s.StringNames[i]
+		}
+		if n := len([]rune(names[i])); n > nameWidth {
+			nameWidth = n
+		}
+	}
+	for i := range names {
+		names[i] += strings.Repeat(" ", nameWidth-len([]rune(names[i]))) + "|"
+	}
+
+	var row [][]string
+	rowWidth := 0
+	flush := func() {
+		if len(row) == 0 {
+			return
+		}
+		for i, name := range names {
+			b.WriteString(name)
+			for _, m := range row {
+				b.WriteString(m[i])
+			}
+			b.WriteString("\n")
+		}
+		row, rowWidth = nil, 0
+	}
+
+	for i, m := range s.Measures {
+		rendered := m.ascii(lines, capo)
+		w := len(rendered[0])
+		if len(row) > 0 && nameWidth+1+rowWidth+w > width {
+			flush()
+			b.WriteString("\n")
+		}
+		row = append(row, rendered)
+		rowWidth += w
+
+		if i == len(s.Measures)-1 {
+			flush()
+		}
+	}
+}
+
+// ascii renders a measure as one string per line, all of the same length.
+// Every beat is as wide as its widest fret number.
+func (m *MeasureData) ascii(lines int, capo int) []string {
+	beats := m.Beats
+	for _, str := range m.Strings {
+		if len(str.Notes) > beats {
+			beats = len(str.Notes)
+		}
+	}
+
+	cells := make([][]string, lines)
+	widths := make([]int, beats)
+	for i := range cells {
+		cells[i] = make([]string, beats)
+		for j := range cells[i] {
+			if i >= len(m.Strings) || j >= len(m.Strings[i].Notes) {
+				continue
+			}
+			if m.Strings[i].Notes[j].FretNumber != nil {
+				// a fret below the capo sounds as the string at the capo
+				fret := *m.Strings[i].Notes[j].FretNumber
+				if fret < capo {
+					fret = capo
+				}
+				cells[i][j] = strconv.Itoa(fret - capo)
+			}
+			if len(cells[i][j]) > widths[j] {
+				widths[j] = len(cells[i][j])
+			}
+		}
+	}
+
+	res := make([]string, lines)
+	for i := range res {
+		var b strings.Builder
+		for j, cell := range cells[i] {
+			w := widths[j]
+			if w == 0 {
+				w = 1
+			}
+			b.WriteString("--" + cell + strings.Repeat("-", w-len(cell)))
+		}
+		b.WriteString("--|")
+		res[i] = b.String()
+	}
+	return res
+}
+
+var ErrNoTablature = errors.New("no tablature found")
+
+// A tab line is an optional string name followed by dashes, frets and bars.
+// It has to start with a name or a bar, so a line of dashes under a title is
+// not taken for a string.
+var tabLine = regexp.MustCompile(`^([A-Ga-g][#b]?[0-9]?)?\s*([|-][-0-9|:*.hpbrx/\\~()^<>v=]*)$`)
+var capoLine = regexp.MustCompile(`(?i)^capo\b\D*([0-9]+)`)
+var headingLine = regexp.MustCompile(`^\[(.*)\]$`)
+
+// techniques are the marks of techniques the tab model can't store yet.
+// Repeat signs and other marks are skipped without a warning.
+const techniques = "hpbrx/\\~()^<>v="
+
+type asciiLine struct {
+	number   int
+	name     string
+	measures []string
+}
+
+// ParseASCII reads plain text tablature as ASCII writes it or as people
+// type it: blocks of lines like e|--0--3--|, one for every string, with bars
+// between the measures. A heading in brackets starts a section, a line
+// starting with "Capo" sets the capo and the first other line before the
+// tablature is the name. Frets are relative to the capo.
+//
+// The beats of a measure are inferred from the spacing of its notes. Marks
+// of techniques like hammer-ons (h), pull-offs (p) and slides (/) are
+// skipped, keeping their notes. Lines which can't be read are returned as
+// warnings.
+func ParseASCII(text string) (*TabData, []Warning, error) {
+	p := asciiParser{warnings: warnings{}, beats: DefaultConfig().StartNotesPerMeasure}
+
+	var block []asciiLine
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		number := i + 1
+		line = strings.TrimSpace(line)
+
+		if m := tabLine.FindStringSubmatch(line); m != nil && isTabLine(m[1], m[2]) {
+			block = append(block, asciiLine{number, m[1], splitMeasures(m[2])})
+			continue
+		}
+
+		p.block(block)
+		block = nil
+
+		switch m := capoLine.FindStringSubmatch(line); {
+		case line == "":
+		case m != nil:
+			capo, _ := strconv.Atoi(m[1])
+			if capo > MaxCapo {
+				p.warnings.add(number, "capo %d is above %d, ignored", capo, MaxCapo)
+			} else {
+				p.capo = capo
+			}
+		case headingLine.MatchString(line):
+			p.heading = strings.TrimSpace(headingLine.FindStringSubmatch(line)[1])
+			p.newSection = true
+		case p.name == "" && len(p.sections) == 0:
+			p.name = line
+		default:
+			p.warnings.add(number, "not tablature, ignored")
+		}
+	}
+	p.block(block)
+
+	if len(p.sections) == 0 {
+		return nil, p.warnings, ErrNoTablature
+	}
+	return imported(p.name, p.capo, p.sections), p.warnings, nil
+}
+
+func isTabLine(name string, body string) bool {
+	if !strings.Contains(body, "-") {
+		return false
+	}
+	return name != "" || strings.Contains(body, "|")
+}
+
+// splitMeasures splits a line at its bars, leaving out the empty measures
+// of double bars and of the bars around the line.
+func splitMeasures(body string) []string {
+	var res []string
+	for _, m := range strings.Split(body, "|") {
+		if m != "" {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+type asciiParser struct {
+	name       string
+	capo       int
+	sections   []SectionData
+	heading    string
+	newSection bool
+	warnings   warnings
+
+	// the beats and spacing of the last measure
+	beats int
+	step  int
+}
+
+// block adds the measures of a block of tab lines to the current section,
+// or to a new one after a heading or when the strings change.
+func (p *asciiParser) block(lines []asciiLine) {
+	if len(lines) == 0 {
+		return
+	}
+	first := lines[0].number
+
+	if len(lines) > MaxStrings {
+		p.warnings.add(first, "%d strings, at most %d are supported, left out", len(lines), MaxStrings)
+		return
+	}
+
+	names := make([]string, len(lines))
+	named := false
+	measures := 0
+	for i, line := range lines {
+		names[i] = line.name
+		named = named || line.name != ""
+		if len(line.measures) > measures {
+			measures = len(line.measures)
+		}
+	}
+	if !named {
+		names = defaultStringNames(len(lines))
+	}
+
+	for _, line := range lines {
+		if len(line.measures) < measures {
+			p.warnings.add(line.number, "has %d measures, but the block has %d", len(line.measures), measures)
+		}
+	}
+
+	n := len(p.sections)
+	if p.newSection || n == 0 || !equalNames(p.sections[n-1].StringNames, names) {
+		p.sections = append(p.sections, SectionData{
+			Measures:    []MeasureData{},
+			StringNames: names,
+			Name:        p.heading,
+		})
+		p.heading, p.newSection = "", false
+		n += 1
+	}
+	section := &p.sections[n-1]
+
+	for i := 0; i < measures; i++ {
+		segments := make([]string, len(lines))
+		for j, line := range lines {
+			if i < len(line.measures) {
+				segments[j] = line.measures[i]
+			}
+		}
+
+		section.Measures = append(section.Measures, p.measure(lines, segments))
+	}
+}
+
+// defaultStringNames names strings when the tab doesn't: standard tuning for
+// six strings, and numbers otherwise.
+func defaultStringNames(count int) []string {
+	if config := DefaultConfig(); count == len(config.StringNames) {
+		return config.StringNames
+	}
+	res := make([]string, count)
+	for i := range res {
+		res[i] = strconv.Itoa(i + 1)
+	}
+	return res
+}
+
+func equalNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type asciiNote struct {
+	str   int
+	start int
+	end   int
+	fret  int
+}
+
+type asciiBeat struct {
+	start   int
+	end     int
+	notes   []asciiNote
+	strings map[int]bool
+}
+
+// measure reads a measure from the same segment of every line. Notes which
+// overlap, like a 12 above a 5, are played together. Multi-digit frets take
+// more columns than a beat, so columns are counted as if every fret had one
+// digit, and the beats of the measure follow from the smallest spacing which
+// all notes fit on. When there is no such spacing every beat gets a note.
+// Measures with fewer than two beats reuse the spacing and the beats of the
+// measure before them.
+func (p *asciiParser) measure(lines []asciiLine, segments []string) MeasureData {
+	var notes []asciiNote
+	length := 0
+	marked := map[int]bool{}
+	for i, segment := range segments {
+		if len(segment) > length {
+			length = len(segment)
+		}
+
+		for j := 0; j < len(segment); j++ {
+			c := segment[j]
+			if strings.IndexByte(techniques, c) >= 0 && !marked[i] {
+				p.warnings.add(lines[i].number, "techniques like h, p and / are not supported, only their notes were kept")
+				marked[i] = true
+			}
+			if c < '0' || c > '9' {
+				continue
+			}
+
+			end := j
+			for end < len(segment) && segment[end] >= '0' && segment[end] <= '9' {
+				end += 1
+			}
+			fret, _ := strconv.Atoi(segment[j:end])
+			if fret > MaxFret {
+				p.warnings.add(lines[i].number, "fret %d is above %d, left out", fret, MaxFret)
+			} else {
+				notes = append(notes, asciiNote{i, j, end, fret})
+			}
+			j = end - 1
+		}
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].start < notes[j].start
+	})
+
+	var beatList []*asciiBeat
+	for _, note := range notes {
+		n := len(beatList)
+		if n > 0 && note.start < beatList[n-1].end && !beatList[n-1].strings[note.str] {
+			last := beatList[n-1]
+			last.notes = append(last.notes, note)
+			last.strings[note.str] = true
+			if note.end > last.end {
+				last.end = note.end
+			}
+			continue
+		}
+		beatList = append(beatList, &asciiBeat{note.start, note.end, []asciiNote{note}, map[int]bool{note.str: true}})
+	}
+
+	// columns as if every fret had one digit
+	columns := make([]int, len(beatList))
+	shift := 0
+	for i, beat := range beatList {
+		columns[i] = beat.start - shift
+		shift += beat.end - beat.start - 1
+	}
+	length -= shift
+
+	beats, step := p.beats, p.step
+	if len(beatList) >= 2 {
+		step = 0
+		for i := 1; i < len(columns); i++ {
+			step = gcd(step, columns[i]-columns[i-1])
+		}
+		if step < 2 {
+			step = 0
+		}
+	}
+	if len(beatList) < 2 && step == 0 && length >= beats {
+		step = length / beats
+	}
+
+	indices := make([]int, len(beatList))
+	count := len(beatList)
+	if step > 0 {
+		count = length / step
+		for i, column := range columns {
+			indices[i] = column / step
+			if indices[i] >= count {
+				count = indices[i] + 1
+			}
+		}
+	}
+	if step == 0 || count > MaxBeats {
+		step = 0
+		count = len(beatList)
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	if count > MaxBeats {
+		p.warnings.add(lines[0].number, "a measure has %d beats, at most %d are supported, the rest was left out", count, MaxBeats)
+		count = MaxBeats
+	}
+	if count == 0 {
+		count = beats
+	}
+
+	res := DefaultMeasure(len(lines), count)
+	for i, beat := range beatList {
+		if indices[i] >= count {
+			break
+		}
+		for _, note := range beat.notes {
+			res.Strings[note.str].Notes[indices[i]].FretNumber = Fret(note.fret)
+		}
+	}
+	p.beats, p.step = count, step
+	return res
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
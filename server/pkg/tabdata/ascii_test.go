@@ -0,0 +1,20 @@
+package tabdata
+
+import (
+	"strings"
+	"testing"
+)
+
+// A fret below the capo is written as the string at the capo.
+func TestASCIIBelowCapo(t *testing.T) {
+	tab := Default("")
+	tab.Capo = Fret(3)
+	tab.Sections[0].Measures[0].Strings[5].Notes[0].FretNumber = Fret(1)
+	tab.Sections[0].Measures[0].Strings[5].Notes[1].FretNumber = Fret(5)
+
+	res := tab.ASCII(DefaultLineWidth)
+	want := "E|--0--2--------|"
+	if !strings.Contains(res, want) {
+		t.Errorf("got\n%s\nwant the line %s", res, want)
+	}
+}
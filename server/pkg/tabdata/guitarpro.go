@@ -0,0 +1,891 @@
+package tabdata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrNotGuitarPro = errors.New("not a Guitar Pro 3, 4 or 5 file")
+var ErrDamagedGuitarPro = errors.New("the Guitar Pro file is damaged")
+var ErrUnknownTrack = errors.New("the Guitar Pro file has no such track")
+
+var gpVersion = regexp.MustCompile(`^FICHIER GUITAR PRO [vL]([345])\.([0-9]+)`)
+
+// gpQuarter is the length of a quarter note in ticks. Every duration Guitar
+// Pro can write, down to dotted tuplets of 256th notes, is a whole number of
+// these ticks.
+const gpQuarter = 5765760
+
+// gpTuplets maps the notes of a tuplet to the notes it is played in the time
+// of, like 3 eighths in the time of 2.
+var gpTuplets = map[int]int{3: 2, 5: 4, 6: 4, 7: 4, 9: 8, 10: 8, 11: 8, 12: 8, 13: 8}
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// gpReader reads the little endian values of a Guitar Pro file. The first
+// read past the end sets err, after which everything reads as zero.
+type gpReader struct {
+	data  []byte
+	pos   int
+	err   error
+	major int
+	minor int
+
+	// features counts what the tab model can't store, for the track which
+	// is imported. It is nil while other tracks are read.
+	features *gpFeatures
+	measure  int
+}
+
+func (r *gpReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = ErrDamagedGuitarPro
+		return nil
+	}
+	res := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return res
+}
+
+func (r *gpReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *gpReader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *gpReader) i8() int {
+	return int(int8(r.u8()))
+}
+
+func (r *gpReader) i32() int {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int(int32(binary.LittleEndian.Uint32(b)))
+}
+
+// count reads the number of items which follow. Every item takes at least
+// a byte, so there can't be more of them than there are bytes left.
+func (r *gpReader) count() int {
+	n := r.i32()
+	if n < 0 || n > len(r.data)-r.pos {
+		if r.err == nil {
+			r.err = ErrDamagedGuitarPro
+		}
+		return 0
+	}
+	return n
+}
+
+// byteString reads a string of at most size bytes, stored in size bytes
+// after its length.
+func (r *gpReader) byteString(size int) string {
+	n := r.u8()
+	b := r.bytes(size)
+	if n > len(b) {
+		n = len(b)
+	}
+	return latin1(b[:n])
+}
+
+// intString reads a string stored after its length.
+func (r *gpReader) intString() string {
+	return latin1(r.bytes(r.count()))
+}
+
+// intByteString reads a string stored after its length plus one, and its
+// length again.
+func (r *gpReader) intByteString() string {
+	size := r.count() - 1
+	n := r.u8()
+	if size < 0 {
+		size = n
+	}
+	b := r.bytes(size)
+	if n > len(b) {
+		n = len(b)
+	}
+	return latin1(b[:n])
+}
+
+// latin1 decodes the Windows-1252 strings of Guitar Pro, which are close
+// enough to Latin-1 for titles and names.
+func latin1(b []byte) string {
+	res := make([]rune, len(b))
+	for i, c := range b {
+		res[i] = rune(c)
+	}
+	return string(res)
+}
+
+func (r *gpReader) v5() bool {
+	return r.major == 5
+}
+
+// v510 is true from Guitar Pro 5.1, which added to some of the records of
+// 5.0.
+func (r *gpReader) v510() bool {
+	return r.major == 5 && r.minor > 0
+}
+
+type gpFeatures struct {
+	names []string
+	count map[string]int
+	first map[string]int
+}
+
+// unsupported records that the imported track uses a feature the tab model
+// doesn't have.
+func (r *gpReader) unsupported(name string) {
+	f := r.features
+	if f == nil {
+		return
+	}
+	if f.count[name] == 0 {
+		f.names = append(f.names, name)
+		f.first[name] = r.measure
+	}
+	f.count[name] += 1
+}
+
+type gpHeader struct {
+	numerator   int
+	denominator int
+	marker      string
+	repeat      bool
+	alternate   bool
+	tripletFeel bool
+}
+
+type gpTrack struct {
+	name       string
+	percussion bool
+	tuning     []int
+	capo       int
+}
+
+type gpNote struct {
+	str  int
+	fret int
+}
+
+type gpBeat struct {
+	ticks int
+	notes []gpNote
+}
+
+// ParseGuitarPro reads a tab from a Guitar Pro 3, 4 or 5 file. The tab model
+// has a single instrument, so only one track is read: the track-th, counting
+// from 1, or the first track which isn't percussion when track is 0. Its
+// tuning names the strings and its capo becomes the capo of the tab, while
+// markers start sections. What the tab model can't store, like the other
+// tracks, bends or ties, is left out and returned as warnings.
+//
+// The tab model has no durations, so every measure is divided in beats of
+// the shortest length all of its notes start on. A quarter note in a measure
+// of eighths takes one beat and is followed by a rest.
+func ParseGuitarPro(data []byte, track int) (*TabData, []Warning, error) {
+	r := &gpReader{data: data}
+	m := gpVersion.FindStringSubmatch(r.byteString(30))
+	if m == nil {
+		return nil, nil, ErrNotGuitarPro
+	}
+	r.major, _ = strconv.Atoi(m[1])
+	r.minor, _ = strconv.Atoi(m[2])
+
+	warns := warnings{}
+	features := &gpFeatures{count: map[string]int{}, first: map[string]int{}}
+
+	title := r.readInfo()
+	tripletFeel := false
+	if !r.v5() {
+		tripletFeel = r.u8() != 0
+	}
+	if r.major >= 4 && r.readLyrics() {
+		warns.add(0, "lyrics: not supported, left out")
+	}
+	if r.v5() {
+		r.readPageSetup()
+	}
+	r.readTempoAndKey()
+	r.skip(64 * 12) // midi channels
+	if r.v5() {
+		r.skip(19 * 2) // directions like da capo
+		r.skip(4)      // reverb
+	}
+
+	headers := make([]gpHeader, r.count())
+	tracks := make([]gpTrack, r.count())
+	for i := range headers {
+		headers[i] = r.readMeasureHeader(i, headers)
+		tripletFeel = tripletFeel || headers[i].tripletFeel
+	}
+
+	for i := range tracks {
+		tracks[i] = r.readTrack(i)
+	}
+	if r.v5() {
+		if r.minor == 0 {
+			r.skip(2)
+		} else {
+			r.skip(1)
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	selected := track - 1
+	if track <= 0 {
+		selected = -1
+		for i, t := range tracks {
+			if !t.percussion {
+				selected = i
+				break
+			}
+		}
+	}
+	if selected < 0 || selected >= len(tracks) {
+		return nil, nil, ErrUnknownTrack
+	}
+
+	measures := make([][]gpBeat, len(headers))
+	for i, header := range headers {
+		r.measure = i + 1
+		for j, t := range tracks {
+			if j != selected {
+				r.readMeasure(len(t.tuning))
+				continue
+			}
+
+			r.features = features
+			if header.repeat {
+				r.unsupported("repeats")
+			}
+			if header.alternate {
+				r.unsupported("alternate endings")
+			}
+			measures[i] = r.readMeasure(len(t.tuning))
+			r.features = nil
+		}
+		if r.err != nil {
+			break
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	t := tracks[selected]
+	if len(tracks) > 1 {
+		var names []string
+		for i, other := range tracks {
+			if i != selected {
+				names = append(names, strconv.Quote(other.name))
+			}
+		}
+		warns.add(0, "only one track can be imported, left out %s", strings.Join(names, ", "))
+	}
+	if t.percussion {
+		warns.add(0, "percussion: not supported, the drums were read as frets")
+	}
+	if tripletFeel {
+		warns.add(0, "triplet feel: not supported, left out")
+	}
+
+	capo := t.capo
+	if capo < 0 || capo > MaxCapo {
+		warns.add(0, "capo %d is not between 0 and %d, left out", capo, MaxCapo)
+		capo = 0
+	}
+
+	names := tuningNames(t.tuning)
+	var sections []SectionData
+	for i, header := range headers {
+		if i == 0 || header.marker != "" {
+			sections = append(sections, SectionData{
+				Measures:    []MeasureData{},
+				StringNames: names,
+				Name:        header.marker,
+			})
+		}
+		section := &sections[len(sections)-1]
+		measure := gpMeasure(header, measures[i], len(t.tuning), i+1, &warns)
+		section.Measures = append(section.Measures, measure)
+	}
+	if len(sections) == 0 {
+		return nil, nil, ErrNoTablature
+	}
+
+	for _, name := range features.names {
+		warns.add(0, "%s: not supported, left out %s, first in measure %d",
+			name, times(features.count[name]), features.first[name])
+	}
+
+	return imported(title, capo, sections), warns, nil
+}
+
+func times(n int) string {
+	if n == 1 {
+		return "once"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+// tuningNames names the strings after the notes they are tuned to. Like in
+// standard tuning, the highest string is written in lower case when another
+// string has the same name.
+func tuningNames(tuning []int) []string {
+	res := make([]string, len(tuning))
+	for i, note := range tuning {
+		res[i] = noteNames[((note%12)+12)%12]
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i] == res[0] {
+			res[0] = strings.ToLower(res[0])
+			break
+		}
+	}
+	return res
+}
+
+// gpMeasure divides a measure in beats, see ParseGuitarPro. Measures which
+// would get more than MaxBeats beats get a beat for every note instead.
+func gpMeasure(header gpHeader, beats []gpBeat, stringCount int, number int, warns *warnings) MeasureData {
+	beatTicks := 4 * gpQuarter / header.denominator
+	length := header.numerator * beatTicks
+
+	starts := make([]int, len(beats))
+	unit := beatTicks
+	position := 0
+	for i, beat := range beats {
+		starts[i] = position
+		unit = gcd(unit, position)
+		position += beat.ticks
+	}
+	if position > length {
+		length = position
+	}
+
+	count := header.numerator
+	indices := make([]int, len(beats))
+	if unit > 0 {
+		count = length / unit
+		for i, start := range starts {
+			indices[i] = start / unit
+		}
+	}
+	if count > MaxBeats {
+		count = len(beats)
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	if count > MaxBeats {
+		warns.add(0, "measure %d has %d beats, at most %d are supported, the rest was left out", number, count, MaxBeats)
+		count = MaxBeats
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	res := DefaultMeasure(stringCount, count)
+	for i, beat := range beats {
+		if indices[i] >= count {
+			break
+		}
+		for _, note := range beat.notes {
+			if note.fret > MaxFret {
+				warns.add(0, "fret %d in measure %d is above %d, left out", note.fret, number, MaxFret)
+				continue
+			}
+			res.Strings[note.str].Notes[indices[i]].FretNumber = Fret(note.fret)
+		}
+	}
+	return res
+}
+
+// readInfo reads the title, artist and other texts about the song, and
+// returns the title.
+func (r *gpReader) readInfo() string {
+	title := r.intByteString()
+	texts := 7 // subtitle, artist, album, words, copyright, tab and instructions
+	if r.v5() {
+		texts += 1 // music
+	}
+	for i := 0; i < texts; i++ {
+		r.intByteString()
+	}
+
+	notice := r.count()
+	for i := 0; i < notice && r.err == nil; i++ {
+		r.intByteString()
+	}
+	return title
+}
+
+// readLyrics reads the lyrics of Guitar Pro 4 and 5, and reports whether
+// there are any.
+func (r *gpReader) readLyrics() bool {
+	res := false
+	r.skip(4) // track
+	for i := 0; i < 5; i++ {
+		r.skip(4) // first measure
+		if strings.TrimSpace(r.intString()) != "" {
+			res = true
+		}
+	}
+	return res
+}
+
+func (r *gpReader) readPageSetup() {
+	if r.v510() {
+		r.skip(19) // master effect
+	}
+	r.skip(30) // page size, margins and proportions
+	for i := 0; i < 11; i++ {
+		r.intByteString() // header and footer texts, and the tempo name
+	}
+}
+
+func (r *gpReader) readTempoAndKey() {
+	switch r.major {
+	case 3:
+		r.skip(4 + 4) // tempo and key
+	case 4:
+		r.skip(4 + 4 + 1) // tempo, key and octave
+	case 5:
+		r.skip(4) // tempo
+		if r.v510() {
+			r.skip(1) // hide tempo
+		}
+		r.skip(4 + 1) // key and octave
+	}
+}
+
+// readMeasureHeader reads the time signature, repeats and marker of a
+// measure. Time signatures which aren't given are those of the measure
+// before.
+func (r *gpReader) readMeasureHeader(i int, headers []gpHeader) gpHeader {
+	if r.v5() && i > 0 {
+		r.skip(1)
+	}
+
+	res := gpHeader{numerator: 4, denominator: 4}
+	if i > 0 {
+		res.numerator, res.denominator = headers[i-1].numerator, headers[i-1].denominator
+	}
+
+	flags := r.u8()
+	if flags&0x01 != 0 {
+		res.numerator = r.i8()
+	}
+	if flags&0x02 != 0 {
+		res.denominator = r.i8()
+	}
+	res.repeat = flags&0x0c != 0
+	res.alternate = flags&0x10 != 0
+	if flags&0x08 != 0 {
+		r.skip(1) // repeat count
+	}
+	if !r.v5() && flags&0x10 != 0 {
+		r.skip(1) // alternate ending
+	}
+	if flags&0x20 != 0 {
+		res.marker = strings.TrimSpace(r.intByteString())
+		r.skip(4) // color
+	}
+	if r.v5() && flags&0x10 != 0 {
+		r.skip(1) // alternate ending
+	}
+	if flags&0x40 != 0 {
+		r.skip(2) // key
+	}
+	if r.v5() {
+		if flags&0x03 != 0 {
+			r.skip(4) // beams
+		}
+		if flags&0x10 == 0 {
+			r.skip(1)
+		}
+		res.tripletFeel = r.u8() != 0
+	}
+
+	if res.numerator < 1 || res.denominator < 1 || res.denominator > 64 || gpQuarter*4%res.denominator != 0 {
+		r.err = ErrDamagedGuitarPro
+	}
+	return res
+}
+
+func (r *gpReader) readTrack(i int) gpTrack {
+	var res gpTrack
+
+	flags := r.u8()
+	res.percussion = flags&0x01 != 0
+	if r.v5() && (i == 0 || r.minor == 0) {
+		r.skip(1)
+	}
+	res.name = r.byteString(40)
+
+	count := r.i32()
+	if (count < 1 || count > 7) && r.err == nil {
+		r.err = ErrDamagedGuitarPro
+		return res
+	}
+	for j := 0; j < 7; j++ {
+		note := r.i32()
+		if j < count {
+			res.tuning = append(res.tuning, note)
+		}
+	}
+
+	r.skip(4)     // port
+	r.skip(4 + 4) // channels
+	r.skip(4)     // frets
+	res.capo = r.i32()
+	r.skip(4) // color
+
+	if r.v5() {
+		if r.v510() {
+			r.skip(49)
+			r.intByteString() // sound effect
+			r.intByteString() // and its category
+		} else {
+			r.skip(44)
+		}
+	}
+	return res
+}
+
+// readMeasure reads the beats of a measure of a track. Guitar Pro 5 has a
+// second voice, which is left out.
+func (r *gpReader) readMeasure(stringCount int) []gpBeat {
+	var res []gpBeat
+	n := r.count()
+	for i := 0; i < n && r.err == nil; i++ {
+		res = append(res, r.readBeat(stringCount))
+	}
+
+	if r.v5() {
+		features := r.features
+		second := false
+		n := r.count()
+		for i := 0; i < n && r.err == nil; i++ {
+			r.features = nil
+			if beat := r.readBeat(stringCount); len(beat.notes) > 0 {
+				second = true
+			}
+		}
+		r.features = features
+		if second {
+			r.unsupported("second voice")
+		}
+		r.skip(1) // line break
+	}
+	return res
+}
+
+func (r *gpReader) readBeat(stringCount int) gpBeat {
+	var res gpBeat
+
+	flags := r.u8()
+	if flags&0x40 != 0 {
+		r.skip(1) // empty or rest
+	}
+
+	value := r.i8()
+	if value < -2 {
+		value = -2
+	}
+	if value > 6 {
+		value = 6
+	}
+	res.ticks = 4 * gpQuarter >> uint(value+2)
+	if flags&0x01 != 0 {
+		res.ticks = res.ticks * 3 / 2
+	}
+	if flags&0x20 != 0 {
+		n := r.i32()
+		if times, ok := gpTuplets[n]; ok {
+			res.ticks = res.ticks * times / n
+		}
+	}
+
+	if flags&0x02 != 0 {
+		r.unsupported("chord diagrams")
+		r.readChord()
+	}
+	if flags&0x04 != 0 {
+		r.unsupported("texts")
+		r.intByteString()
+	}
+	if flags&0x08 != 0 {
+		r.readBeatEffects()
+	}
+	if flags&0x10 != 0 {
+		r.unsupported("tempo and instrument changes")
+		r.readMixTableChange()
+	}
+
+	// the highest string is the highest of 7 bits, and only the strings the
+	// track has are stored
+	flags = r.u8()
+	for i := 0; i < stringCount; i++ {
+		if flags&(0x40>>uint(i)) == 0 {
+			continue
+		}
+		if fret, ok := r.readNote(); ok {
+			res.notes = append(res.notes, gpNote{i, fret})
+		}
+	}
+
+	if r.v5() {
+		r.skip(1)
+		if r.u8()&0x08 != 0 {
+			r.skip(1) // secondary beam break
+		}
+	}
+	return res
+}
+
+func (r *gpReader) readChord() {
+	if r.v5() {
+		r.skip(1 + 16 + 22 + 4 + 4 + 7*4 + 32)
+		return
+	}
+
+	if r.u8()&0x01 == 0 {
+		r.intByteString() // name
+		if r.i32() != 0 {
+			r.skip(6 * 4) // frets
+		}
+		return
+	}
+
+	if r.major == 3 {
+		r.skip(25 + 35 + 4 + 6*4 + 36)
+	} else {
+		r.skip(16 + 22 + 4 + 4 + 7*4 + 32)
+	}
+}
+
+func (r *gpReader) readBeatEffects() {
+	flags1 := r.u8()
+	flags2 := 0
+	if r.major >= 4 {
+		flags2 = r.u8()
+	}
+
+	if flags1&0x01 != 0 || flags1&0x02 != 0 {
+		r.unsupported("vibrato")
+	}
+	if flags1&0x10 != 0 {
+		r.unsupported("fade in")
+	}
+	if flags1&0x04 != 0 || flags1&0x08 != 0 {
+		r.unsupported("harmonics")
+	}
+
+	if flags1&0x20 != 0 {
+		slap := r.u8()
+		if slap != 0 {
+			r.unsupported("tapping, slapping and popping")
+		}
+		if r.major == 3 {
+			if slap == 0 {
+				r.unsupported("tremolo bar")
+			}
+			r.skip(4)
+		}
+	}
+	if flags2&0x04 != 0 {
+		r.unsupported("tremolo bar")
+		r.readBend()
+	}
+	if flags1&0x40 != 0 {
+		r.unsupported("strokes")
+		r.skip(2)
+	}
+	if flags2&0x02 != 0 {
+		r.unsupported("pick strokes")
+		r.skip(1)
+	}
+}
+
+func (r *gpReader) readMixTableChange() {
+	r.skip(1) // instrument
+	if r.v5() {
+		r.skip(16) // sound
+	}
+	values := make([]int, 6) // volume, balance, chorus, reverb, phaser and tremolo
+	for i := range values {
+		values[i] = r.i8()
+	}
+	if r.v5() {
+		r.intByteString() // tempo name
+	}
+	tempo := r.i32()
+
+	// how long the changes take
+	for _, value := range values {
+		if value >= 0 {
+			r.skip(1)
+		}
+	}
+	if tempo >= 0 {
+		r.skip(1)
+		if r.v510() {
+			r.skip(1) // hide tempo
+		}
+	}
+
+	if r.major >= 4 {
+		r.skip(1) // tracks the changes apply to
+	}
+	if r.v5() {
+		r.skip(1) // wah
+	}
+	if r.v510() {
+		r.intByteString() // sound effect
+		r.intByteString() // and its category
+	}
+}
+
+func (r *gpReader) readBend() {
+	r.skip(1 + 4) // type and value
+	points := r.count()
+	r.skip(points * (4 + 4 + 1))
+}
+
+// readNote reads a note, and returns its fret unless the note can't be
+// stored: tied notes hold a note played before, and dead notes have no fret.
+func (r *gpReader) readNote() (int, bool) {
+	flags := r.u8()
+	ok := true
+
+	if flags&0x20 != 0 {
+		switch r.u8() {
+		case 2:
+			r.unsupported("tied notes")
+			ok = false
+		case 3:
+			r.unsupported("dead notes")
+			ok = false
+		}
+	}
+	if flags&0x04 != 0 {
+		r.unsupported("ghost notes")
+	}
+	if flags&0x40 != 0 || (r.v5() && flags&0x02 != 0) {
+		r.unsupported("accents")
+	}
+	if !r.v5() && flags&0x01 != 0 {
+		r.skip(2) // duration and tuplet
+	}
+	if flags&0x10 != 0 {
+		r.skip(1) // dynamic
+	}
+
+	fret := 0
+	if flags&0x20 != 0 {
+		fret = r.i8()
+	} else {
+		ok = false
+	}
+	if fret < 0 {
+		ok = false
+	}
+
+	if flags&0x80 != 0 {
+		r.unsupported("fingerings")
+		r.skip(2)
+	}
+	if r.v5() {
+		if flags&0x01 != 0 {
+			r.skip(8) // duration percent
+		}
+		r.skip(1)
+	}
+	if flags&0x08 != 0 {
+		r.readNoteEffects()
+	}
+	return fret, ok
+}
+
+func (r *gpReader) readNoteEffects() {
+	flags1 := r.u8()
+	flags2 := 0
+	if r.major >= 4 {
+		flags2 = r.u8()
+	}
+
+	if flags1&0x02 != 0 {
+		r.unsupported("hammer-ons and pull-offs")
+	}
+	if flags1&0x08 != 0 {
+		r.unsupported("let ring")
+	}
+	if flags1&0x01 != 0 {
+		r.unsupported("bends")
+		r.readBend()
+	}
+	if flags1&0x10 != 0 {
+		r.unsupported("grace notes")
+		if r.v5() {
+			r.skip(5)
+		} else {
+			r.skip(4)
+		}
+	}
+	if r.major == 3 && flags1&0x04 != 0 {
+		r.unsupported("slides")
+	}
+
+	if flags2&0x01 != 0 {
+		r.unsupported("staccato")
+	}
+	if flags2&0x02 != 0 {
+		r.unsupported("palm mutes")
+	}
+	if flags2&0x04 != 0 {
+		r.unsupported("tremolo picking")
+		r.skip(1)
+	}
+	if flags2&0x08 != 0 {
+		r.unsupported("slides")
+		r.skip(1)
+	}
+	if flags2&0x10 != 0 {
+		r.unsupported("harmonics")
+		harmonic := r.i8()
+		if r.v5() {
+			switch harmonic {
+			case 2:
+				r.skip(3) // the note, its accidental and its octave
+			case 3:
+				r.skip(1) // the tapped fret
+			}
+		}
+	}
+	if flags2&0x20 != 0 {
+		r.unsupported("trills")
+		r.skip(2)
+	}
+	if flags2&0x40 != 0 {
+		r.unsupported("vibrato")
+	}
+}
@@ -0,0 +1,287 @@
+package tabdata
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The fixtures are the same song in every version the importer reads, see
+// testdata/gen_guitarpro.py. They are written from the file format, no file
+// saved by Guitar Pro or TuxGuitar is among them yet.
+var gpFixtures = []string{"v300.gp3", "v406.gp4", "v500.gp5", "v510.gp5"}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// parseGuitarPro is ParseGuitarPro, with a panic reported as a failure of
+// the test instead of ending it.
+func parseGuitarPro(t *testing.T, data []byte, track int) (res *TabData, warns []Warning, err error) {
+	t.Helper()
+	defer func() {
+		if p := recover(); p != nil {
+			t.Errorf("panic on %d bytes: %v", len(data), p)
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return ParseGuitarPro(data, track)
+}
+
+func TestParseGuitarProGolden(t *testing.T) {
+	for _, name := range gpFixtures {
+		for _, track := range []int{1, 2} {
+			t.Run(fmt.Sprintf("%s/track%d", name, track), func(t *testing.T) {
+				res, warns, err := parseGuitarPro(t, readFixture(t, name), track)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				res.Id = "00000000-0000-0000-0000-000000000000"
+				if err := res.Validate(); err != nil {
+					t.Errorf("invalid import: %v", err)
+				}
+
+				got, err := json.MarshalIndent(struct {
+					Tab      *TabData
+					Warnings []string
+				}{res, warningStrings(warns)}, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+
+				golden := filepath.Join("testdata", fmt.Sprintf("%s.track%d.json", name, track))
+				if *update {
+					if err := os.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("import differs from %s, run go test -update to see how:\n%s", golden, got)
+				}
+			})
+		}
+	}
+}
+
+func warningStrings(warns []Warning) []string {
+	res := []string{}
+	for _, w := range warns {
+		res = append(res, w.String())
+	}
+	return res
+}
+
+// notes lists the frets of a tab as section/measure/string/beat=fret.
+func notes(tab *TabData) []string {
+	res := []string{}
+	for i, section := range tab.Sections {
+		for j, m := range section.Measures {
+			for k, str := range m.Strings {
+				for beat, note := range str.Notes {
+					if note.FretNumber != nil {
+						res = append(res, fmt.Sprintf("%d/%d/%d/%d=%d", i, j, k, beat, *note.FretNumber))
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// TestParseGuitarProSong checks the imports against the song as
+// gen_guitarpro.py writes it, where the golden files only hold what the
+// importer made of it before.
+func TestParseGuitarProSong(t *testing.T) {
+	tests := []struct {
+		track       int
+		capo        int
+		stringNames []string
+		beats       []int
+		notes       []string
+	}{
+		{
+			track:       1,
+			capo:        2,
+			stringNames: []string{"e", "B", "G", "D", "A", "E"},
+			// quarters in 4/4, eighths, and triplet eighths in 3/4
+			beats: []int{4, 8, 9},
+			// frets are moved up by the capo, tied and dead notes are left out
+			notes: []string{
+				"0/0/0/0=2", "0/0/1/1=3", "0/0/2/2=14", "0/0/5/0=5",
+				"1/0/0/0=4", "1/0/0/1=5", "1/0/4/6=12",
+				"1/1/0/0=3", "1/1/0/1=4", "1/1/0/2=5", "1/1/1/3=6",
+			},
+		},
+		{
+			track:       2,
+			capo:        0,
+			stringNames: []string{"G", "D", "A", "E"},
+			beats:       []int{4, 4, 3},
+			notes:       []string{"0/0/3/0=5", "1/0/3/0=5"},
+		},
+	}
+
+	for _, name := range gpFixtures {
+		for _, test := range tests {
+			res, _, err := parseGuitarPro(t, readFixture(t, name), test.track)
+			if err != nil {
+				t.Fatalf("%s track %d: %v", name, test.track, err)
+			}
+
+			if res.Name != "Test Song" || res.CapoFret() != test.capo {
+				t.Errorf("%s track %d: %q with capo %d, want %q with capo %d", name, test.track, res.Name, res.CapoFret(), "Test Song", test.capo)
+			}
+			if len(res.Sections) != 2 || res.Sections[0].Name != "" || res.Sections[1].Name != "Chorus" {
+				t.Fatalf("%s track %d: sections %+v, want an unnamed one and Chorus", name, test.track, res.Sections)
+			}
+			if !reflect.DeepEqual(res.Config.StringNames, test.stringNames) {
+				t.Errorf("%s track %d: strings %q, want %q", name, test.track, res.Config.StringNames, test.stringNames)
+			}
+
+			var beats []int
+			for _, section := range res.Sections {
+				for _, m := range section.Measures {
+					beats = append(beats, m.Beats)
+				}
+			}
+			if !reflect.DeepEqual(beats, test.beats) {
+				t.Errorf("%s track %d: measures of %v beats, want %v", name, test.track, beats, test.beats)
+			}
+			if got := notes(res); !reflect.DeepEqual(got, test.notes) {
+				t.Errorf("%s track %d: notes %q, want %q", name, test.track, got, test.notes)
+			}
+		}
+	}
+}
+
+func TestParseGuitarProDefaultTrack(t *testing.T) {
+	for _, name := range gpFixtures {
+		data := readFixture(t, name)
+		first, _, err := parseGuitarPro(t, data, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := parseGuitarPro(t, data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, _ := json.Marshal(first)
+		b, _ := json.Marshal(res)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s: the default track is not the first guitar", name)
+		}
+
+		if _, _, err := parseGuitarPro(t, data, 3); err != ErrUnknownTrack {
+			t.Errorf("%s: got %v for a missing track, want ErrUnknownTrack", name, err)
+		}
+	}
+}
+
+func TestParseGuitarProVersion(t *testing.T) {
+	gp5 := readFixture(t, "v500.gp5")
+	withVersion := func(version string) []byte {
+		res := append([]byte{}, gp5...)
+		copy(res[1:31], fmt.Sprintf("%-30s", "FICHIER GUITAR PRO "+version))
+		res[0] = byte(len("FICHIER GUITAR PRO " + version))
+		return res
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrNotGuitarPro},
+		{"text", []byte("e|--0--|\nB|--1--|\n"), ErrNotGuitarPro},
+		{"short header", gp5[:20], ErrNotGuitarPro},
+		{"version 2", withVersion("v2.21"), ErrNotGuitarPro},
+		{"version 6", withVersion("v6.00"), ErrNotGuitarPro},
+		{"other program", append([]byte{24}, []byte("FICHIER GUITAR PLUS v5.00")...), ErrNotGuitarPro},
+		{"version 5", withVersion("v5.00"), nil},
+		{"version L5", withVersion("L5.00"), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := parseGuitarPro(t, test.data, 0)
+			if err != test.err {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	// every version is read with its own layout, which only fits its own
+	// files
+	for _, name := range gpFixtures {
+		for _, version := range []string{"v3.00", "v4.06", "v5.00", "v5.10"} {
+			data := readFixture(t, name)
+			copy(data[20:25], version)
+			_, _, err := parseGuitarPro(t, data, 0)
+			if (err == nil) != (data[21] == name[1] && string(data[23:25]) == name[2:4]) {
+				t.Errorf("%s read as %s: %v", name, version, err)
+			}
+		}
+	}
+}
+
+func TestParseGuitarProTruncated(t *testing.T) {
+	for _, name := range gpFixtures {
+		data := readFixture(t, name)
+		for n := 0; n < len(data); n++ {
+			_, _, err := parseGuitarPro(t, data[:n], 0)
+			if err != ErrNotGuitarPro && err != ErrDamagedGuitarPro {
+				t.Fatalf("%s cut after %d bytes: got %v, want an error", name, n, err)
+			}
+		}
+	}
+}
+
+// TestParseGuitarProCorrupt damages the fixtures at random. The importer
+// has to notice or carry on, but it may not panic.
+func TestParseGuitarProCorrupt(t *testing.T) {
+	known := map[error]bool{ErrNotGuitarPro: true, ErrDamagedGuitarPro: true, ErrUnknownTrack: true}
+	values := []byte{0, 1, 0x7f, 0x80, 0xff}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, name := range gpFixtures {
+		fixture := readFixture(t, name)
+		for i := 0; i < 2000; i++ {
+			data := append([]byte{}, fixture...)
+			for j := rnd.Intn(4); j >= 0; j-- {
+				pos := 31 + rnd.Intn(len(data)-31)
+				if rnd.Intn(2) == 0 {
+					data[pos] = values[rnd.Intn(len(values))]
+				} else {
+					data[pos] = byte(rnd.Intn(256))
+				}
+			}
+
+			_, _, err := parseGuitarPro(t, data, 0)
+			if err != nil && !known[err] {
+				t.Errorf("%s damaged: unexpected error %v", name, err)
+			}
+			if t.Failed() {
+				t.Fatalf("%s damaged as %x", name, data)
+			}
+		}
+	}
+}
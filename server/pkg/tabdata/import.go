@@ -0,0 +1,57 @@
+package tabdata
+
+import "fmt"
+
+// Warning is something an import could not carry over into the tab. Line is
+// the line of the input it was found on, or 0 when there is none.
+type Warning struct {
+	Line    int
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Line == 0 {
+		return w.Message
+	}
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+type warnings []Warning
+
+func (w *warnings) add(line int, format string, args ...interface{}) {
+	*w = append(*w, Warning{line, fmt.Sprintf(format, args...)})
+}
+
+// imported completes a tab read from another format, which has no id yet.
+// The config follows the first section, so new sections look like it.
+func imported(name string, capo int, sections []SectionData) *TabData {
+	config := DefaultConfig()
+	if len(sections) > 0 {
+		config.StringNames = append([]string{}, sections[0].StringNames...)
+		config.StartStrings = len(config.StringNames)
+	}
+
+	// frets are stored including the capo
+	for _, section := range sections {
+		for _, m := range section.Measures {
+			for _, str := range m.Strings {
+				for _, note := range str.Notes {
+					if note.FretNumber != nil {
+						*note.FretNumber += capo
+					}
+				}
+			}
+		}
+	}
+
+	if name == "" {
+		name = Default("").Name
+	}
+
+	return &TabData{
+		Config:   &config,
+		Sections: sections,
+		Name:     name,
+		Capo:     Fret(capo),
+	}
+}
@@ -0,0 +1,111 @@
+// Package tabdata mirrors the tab model of the editor, TabData in
+// src/typescript, which is what Tab.Contents holds as JSON.
+package tabdata
+
+// TabData is a whole tab. Fret numbers include the capo: a note on the
+// first fret above a capo on the second fret is stored as fret 3.
+type TabData struct {
+	Id       string        `json:"id"`
+	Config   *Config       `json:"config"`
+	Sections []SectionData `json:"sections"`
+	Name     string        `json:"name"`
+	Capo     *int          `json:"capo"`
+}
+
+// Config holds the defaults the editor uses for new sections and measures.
+type Config struct {
+	StartSections        int      `json:"startSections"`
+	StartMeasures        int      `json:"startMeasures"`
+	StartStrings         int      `json:"startStrings"`
+	StartNotesPerMeasure int      `json:"startNotesPerMeasure"`
+	StringNames          []string `json:"stringNames"`
+}
+
+// SectionData is a named run of measures, with the names of its strings
+// from the highest to the lowest.
+type SectionData struct {
+	Measures    []MeasureData `json:"measures"`
+	StringNames []string      `json:"stringNames"`
+	Name        string        `json:"name"`
+}
+
+// MeasureData has a StringData for every string of its section, each with
+// Beats notes.
+type MeasureData struct {
+	Strings []StringData `json:"strings"`
+	Beats   int          `json:"beats"`
+}
+
+type StringData struct {
+	Notes []NoteData `json:"notes"`
+}
+
+// NoteData is a single note, or a rest when FretNumber is nil.
+type NoteData struct {
+	FretNumber *int `json:"fretNumber"`
+}
+
+// DefaultConfig is Config.default() of the editor.
+func DefaultConfig() Config {
+	return Config{
+		StartSections:        1,
+		StartMeasures:        4,
+		StartStrings:         6,
+		StartNotesPerMeasure: 4,
+		StringNames:          []string{"e", "B", "G", "D", "A", "E"},
+	}
+}
+
+// CapoFret is the capo of the tab, 0 when it has none.
+func (t *TabData) CapoFret() int {
+	if t.Capo == nil {
+		return 0
+	}
+	return *t.Capo
+}
+
+// Fret returns a fret number for a NoteData, or a capo.
+func Fret(n int) *int {
+	return &n
+}
+
+// Default is TabData.default() of the editor, which it shows for tabs that
+// were never saved.
+func Default(id string) *TabData {
+	config := DefaultConfig()
+
+	res := &TabData{
+		Id:       id,
+		Config:   &config,
+		Sections: []SectionData{},
+		Name:     "New Tab",
+		Capo:     Fret(0),
+	}
+	for i := 0; i < config.StartSections; i++ {
+		res.Sections = append(res.Sections, DefaultSection(config))
+	}
+	return res
+}
+
+func DefaultSection(config Config) SectionData {
+	res := SectionData{
+		Measures:    []MeasureData{},
+		StringNames: append([]string{}, config.StringNames...),
+	}
+	for i := 0; i < config.StartMeasures; i++ {
+		res.Measures = append(res.Measures, DefaultMeasure(config.StartStrings, config.StartNotesPerMeasure))
+	}
+	return res
+}
+
+// DefaultMeasure is a measure of rests.
+func DefaultMeasure(strings int, beats int) MeasureData {
+	res := MeasureData{
+		Strings: make([]StringData, strings),
+		Beats:   beats,
+	}
+	for i := range res.Strings {
+		res.Strings[i].Notes = make([]NoteData, beats)
+	}
+	return res
+}
@@ -0,0 +1,289 @@
+package tabdata
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const musicXMLHeader = xml.Header + `<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 4.0 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">` + "\n"
+
+// The lowest string is tuned to E2, like on a guitar, unless its name has an
+// octave.
+const lowestOctave = 2
+
+// The octaves MusicXML can write.
+const (
+	minOctave = 0
+	maxOctave = 9
+)
+
+var pitchName = regexp.MustCompile(`^([A-Ga-g])([#b]?)([0-9]?)$`)
+
+var steps = map[string]int{"C": 0, "D": 2, "E": 4, "F": 5, "G": 7, "A": 9, "B": 11}
+
+type mxlScore struct {
+	XMLName  xml.Name    `xml:"score-partwise"`
+	Version  string      `xml:"version,attr"`
+	Work     mxlWork     `xml:"work"`
+	PartList mxlPartList `xml:"part-list"`
+	Part     mxlPart     `xml:"part"`
+}
+
+type mxlWork struct {
+	Title string `xml:"work-title"`
+}
+
+type mxlPartList struct {
+	ScorePart struct {
+		Id   string `xml:"id,attr"`
+		Name string `xml:"part-name"`
+	} `xml:"score-part"`
+}
+
+type mxlPart struct {
+	Id       string       `xml:"id,attr"`
+	Measures []mxlMeasure `xml:"measure"`
+}
+
+type mxlMeasure struct {
+	Number     int            `xml:"number,attr"`
+	Attributes *mxlAttributes `xml:"attributes"`
+	Direction  *mxlDirection  `xml:"direction"`
+	Notes      []mxlNote      `xml:"note"`
+}
+
+type mxlAttributes struct {
+	Divisions    int              `xml:"divisions,omitempty"`
+	Time         *mxlTime         `xml:"time"`
+	Clef         *mxlClef         `xml:"clef"`
+	StaffDetails *mxlStaffDetails `xml:"staff-details"`
+}
+
+type mxlTime struct {
+	Beats    int `xml:"beats"`
+	BeatType int `xml:"beat-type"`
+}
+
+type mxlClef struct {
+	Sign string `xml:"sign"`
+	Line int    `xml:"line"`
+}
+
+type mxlStaffDetails struct {
+	Lines  int         `xml:"staff-lines"`
+	Tuning []mxlTuning `xml:"staff-tuning"`
+	Capo   int         `xml:"capo,omitempty"`
+}
+
+type mxlTuning struct {
+	Line   int    `xml:"line,attr"`
+	Step   string `xml:"tuning-step"`
+	Alter  int    `xml:"tuning-alter,omitempty"`
+	Octave int    `xml:"tuning-octave"`
+}
+
+type mxlDirection struct {
+	Placement string `xml:"placement,attr"`
+	Rehearsal string `xml:"direction-type>rehearsal"`
+}
+
+type mxlNote struct {
+	Chord     *struct{}     `xml:"chord"`
+	Pitch     *mxlPitch     `xml:"pitch"`
+	Rest      *struct{}     `xml:"rest"`
+	Duration  int           `xml:"duration"`
+	Voice     string        `xml:"voice"`
+	Type      string        `xml:"type"`
+	Technical *mxlTechnical `xml:"notations>technical"`
+}
+
+type mxlPitch struct {
+	Step   string `xml:"step"`
+	Alter  int    `xml:"alter,omitempty"`
+	Octave int    `xml:"octave"`
+}
+
+type mxlTechnical struct {
+	String int `xml:"string"`
+	Fret   int `xml:"fret"`
+}
+
+// stringTuning finds the pitches of the strings, as MIDI note numbers, from
+// their names. Names are notes like E, e or F#, optionally with an octave
+// like E2. Without an octave, every string is the first note with its name
+// above the string below it. Strings with other names are tuned a fourth
+// above the string below them.
+func stringTuning(names []string) []int {
+	res := make([]int, len(names))
+	previous := -1
+	for i := len(names) - 1; i >= 0; i-- {
+		m := pitchName.FindStringSubmatch(names[i])
+		switch {
+		case m == nil && previous < 0:
+			res[i] = (lowestOctave+1)*12 + steps["E"]
+		case m == nil:
+			res[i] = previous + 5
+		default:
+			class := steps[strings.ToUpper(m[1])]
+			switch m[2] {
+			case "#":
+				class += 1
+			case "b":
+				class -= 1
+			}
+
+			if m[3] != "" {
+				octave, _ := strconv.Atoi(m[3])
+				res[i] = (octave+1)*12 + class
+			} else if previous < 0 {
+				res[i] = (lowestOctave+1)*12 + class
+			} else {
+				res[i] = previous + 1 + ((class-previous-1)%12+12)%12
+			}
+		}
+		previous = res[i]
+	}
+	return res
+}
+
+// pitch names a MIDI note number, 60 being the C in octave 4. MusicXML only
+// has the octaves 0 to 9, notes outside of them are moved by whole octaves
+// into the nearest one.
+func pitch(note int) mxlPitch {
+	class := (note%12 + 12) % 12
+	name := noteNames[class]
+	res := mxlPitch{Step: name[:1], Octave: (note-class)/12 - 1}
+	if res.Octave < minOctave {
+		res.Octave = minOctave
+	}
+	if res.Octave > maxOctave {
+		res.Octave = maxOctave
+	}
+	if len(name) > 1 {
+		res.Alter = 1
+	}
+	return res
+}
+
+// MusicXML renders the tab as a MusicXML 4.0 score with a single tablature
+// staff. The staff is tuned after the names of the strings, see stringTuning.
+// Every measure becomes a measure with a quarter note for every beat, and
+// the names of the sections become rehearsal marks. Frets are relative to
+// the capo, like in ASCII. Frets below the capo can't be played, they sound
+// like the string at the capo and are written that way.
+func (t *TabData) MusicXML() ([]byte, error) {
+	score := mxlScore{Version: "4.0", Work: mxlWork{t.Name}}
+	score.PartList.ScorePart.Id = "P1"
+	score.PartList.ScorePart.Name = "Guitar"
+	score.Part.Id = "P1"
+
+	// a part needs at least one measure
+	sections := t.Sections
+	if countMeasures(sections) == 0 {
+		config := DefaultConfig()
+		sections = []SectionData{{
+			Measures:    []MeasureData{DefaultMeasure(config.StartStrings, config.StartNotesPerMeasure)},
+			StringNames: config.StringNames,
+		}}
+	}
+
+	capo := t.CapoFret()
+	var names []string
+	beats := 0
+	for i, section := range sections {
+		tuning := stringTuning(section.StringNames)
+
+		for j, m := range section.Measures {
+			measure := mxlMeasure{Number: len(score.Part.Measures) + 1}
+
+			attributes := mxlAttributes{}
+			if measure.Number == 1 {
+				attributes.Divisions = 1
+			}
+			if m.Beats != beats {
+				attributes.Time = &mxlTime{m.Beats, 4}
+				beats = m.Beats
+			}
+			if measure.Number == 1 || !equalNames(names, section.StringNames) {
+				attributes.Clef = &mxlClef{"TAB", 5}
+				attributes.StaffDetails = staffDetails(tuning, capo)
+				names = section.StringNames
+			}
+			if attributes != (mxlAttributes{}) {
+				measure.Attributes = &attributes
+			}
+
+			if j == 0 {
+				switch {
+				case section.Name != "":
+					measure.Direction = &mxlDirection{"above", section.Name}
+				case len(sections) > 1:
+					measure.Direction = &mxlDirection{"above", fmt.Sprintf("Section %d", i+1)}
+				}
+			}
+
+			measure.Notes = musicXMLNotes(m, tuning, capo)
+			score.Part.Measures = append(score.Part.Measures, measure)
+		}
+	}
+
+	res, err := xml.MarshalIndent(score, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(musicXMLHeader), res...), nil
+}
+
+func countMeasures(sections []SectionData) int {
+	res := 0
+	for _, section := range sections {
+		res += len(section.Measures)
+	}
+	return res
+}
+
+// staffDetails tunes the staff, whose lines are numbered from the bottom,
+// so from the lowest string.
+func staffDetails(tuning []int, capo int) *mxlStaffDetails {
+	res := &mxlStaffDetails{Lines: len(tuning), Capo: capo}
+	for i := range tuning {
+		p := pitch(tuning[len(tuning)-1-i])
+		res.Tuning = append(res.Tuning, mxlTuning{i + 1, p.Step, p.Alter, p.Octave})
+	}
+	return res
+}
+
+// musicXMLNotes plays the notes of every beat as a chord, or rests.
+func musicXMLNotes(m MeasureData, tuning []int, capo int) []mxlNote {
+	var res []mxlNote
+	for beat := 0; beat < m.Beats; beat++ {
+		chord := false
+		for i, str := range m.Strings {
+			if i >= len(tuning) || beat >= len(str.Notes) || str.Notes[beat].FretNumber == nil {
+				continue
+			}
+			fret := *str.Notes[beat].FretNumber
+			if fret < capo {
+				fret = capo
+			}
+
+			note := mxlNote{Duration: 1, Voice: "1", Type: "quarter"}
+			if chord {
+				note.Chord = &struct{}{}
+			}
+			p := pitch(tuning[i] + fret)
+			note.Pitch = &p
+			note.Technical = &mxlTechnical{String: i + 1, Fret: fret - capo}
+			res = append(res, note)
+			chord = true
+		}
+
+		if !chord {
+			res = append(res, mxlNote{Rest: &struct{}{}, Duration: 1, Voice: "1", Type: "quarter"})
+		}
+	}
+	return res
+}
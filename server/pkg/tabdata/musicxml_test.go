@@ -0,0 +1,152 @@
+package tabdata
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPitch(t *testing.T) {
+	tests := []struct {
+		note int
+		want mxlPitch
+	}{
+		{60, mxlPitch{"C", 0, 4}},
+		{40, mxlPitch{"E", 0, 2}},
+		{61, mxlPitch{"C", 1, 4}},
+		{12, mxlPitch{"C", 0, 0}},
+		// octaves below 0 and above 9 are moved into them
+		{11, mxlPitch{"B", 0, 0}},
+		{0, mxlPitch{"C", 0, 0}},
+		{-1, mxlPitch{"B", 0, 0}},
+		{-13, mxlPitch{"B", 0, 0}},
+		{-12, mxlPitch{"C", 0, 0}},
+		{131, mxlPitch{"B", 0, 9}},
+		{133, mxlPitch{"C", 1, 9}},
+	}
+
+	for _, test := range tests {
+		if got := pitch(test.note); got != test.want {
+			t.Errorf("pitch(%d) = %+v, want %+v", test.note, got, test.want)
+		}
+	}
+}
+
+func TestStringTuning(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []int
+	}{
+		{[]string{"e", "B", "G", "D", "A", "E"}, []int{64, 59, 55, 50, 45, 40}},
+		{[]string{"G", "D", "A", "E"}, []int{55, 50, 45, 40}},
+		{[]string{"D", "A", "F#", "D", "A", "D"}, []int{62, 57, 54, 50, 45, 38}},
+		{[]string{"e", "B", "G", "D", "A", "E", "B1"}, []int{64, 59, 55, 50, 45, 40, 35}},
+		{[]string{"1", "2", "3"}, []int{50, 45, 40}},
+	}
+
+	for _, test := range tests {
+		got := stringTuning(test.names)
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("stringTuning(%q) = %v, want %v", test.names, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// A fret below the capo is written as the string at the capo.
+func TestMusicXMLBelowCapo(t *testing.T) {
+	tab := Default("")
+	tab.Capo = Fret(3)
+	tab.Sections[0].Measures[0].Strings[5].Notes[0].FretNumber = Fret(1)
+	tab.Sections[0].Measures[0].Strings[5].Notes[1].FretNumber = Fret(5)
+
+	res, err := tab.MusicXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var score mxlScore
+	if err := xml.Unmarshal(res, &score); err != nil {
+		t.Fatal(err)
+	}
+	notes := score.Part.Measures[0].Notes
+	if len(notes) != 4 {
+		t.Fatalf("got %d notes, want 4", len(notes))
+	}
+
+	for i, want := range []struct {
+		fret  int
+		pitch mxlPitch
+	}{
+		{0, mxlPitch{"G", 0, 2}},
+		{2, mxlPitch{"A", 0, 2}},
+	} {
+		n := notes[i]
+		if n.Technical == nil || n.Technical.Fret != want.fret || n.Technical.String != 6 {
+			t.Errorf("note %d is on %+v, want fret %d of string 6", i, n.Technical, want.fret)
+		}
+		if n.Pitch == nil || *n.Pitch != want.pitch {
+			t.Errorf("note %d is %+v, want %+v", i, n.Pitch, want.pitch)
+		}
+	}
+}
+
+// TestMusicXMLSchema validates exports with xmllint. The MusicXML 4.0 schema
+// is not part of the repository, testdata/musicxml-subset.xsd holds the part
+// of it the export uses. Set MUSICXML_XSD to the path of the official
+// musicxml.xsd, with the xlink.xsd and xml.xsd it imports next to it, to
+// validate against the full schema.
+func TestMusicXMLSchema(t *testing.T) {
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint is needed to validate against the schema")
+	}
+	xsd := os.Getenv("MUSICXML_XSD")
+	if xsd == "" {
+		xsd = filepath.Join("testdata", "musicxml-subset.xsd")
+	}
+
+	tabs := map[string]*TabData{"default": Default("")}
+
+	capo := Default("")
+	capo.Capo = Fret(3)
+	capo.Sections[0].Measures[0].Strings[0].Notes[0].FretNumber = Fret(1)
+	tabs["below capo"] = capo
+
+	low := Default("")
+	low.Sections[0].StringNames = []string{"e", "B", "G", "D", "A", "Cb0"}
+	low.Sections[0].Measures[0].Strings[5].Notes[0].FretNumber = Fret(0)
+	tabs["below octave 0"] = low
+
+	for _, name := range gpFixtures {
+		for _, track := range []int{1, 2} {
+			res, _, err := ParseGuitarPro(readFixture(t, name), track)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tabs[fmt.Sprintf("%s track %d", name, track)] = res
+		}
+	}
+
+	dir := t.TempDir()
+	for name, tab := range tabs {
+		res, err := tab.MusicXML()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		file := filepath.Join(dir, "export.musicxml")
+		if err := os.WriteFile(file, res, 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(xmllint, "--noout", "--nonet", "--schema", xsd, file).CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: %v\n%s", name, err, out)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+# Writes the Guitar Pro fixtures: the same song in every supported version.
+#
+# The song has two tracks, a guitar with a capo on the 2nd fret and a bass,
+# and three measures:
+#
+#   1. 4/4, quarter notes, one of them with a chord diagram
+#   2. starts the "Chorus" section with a marker and a repeat; eighths and
+#      quarters with a bend, a mix table change, text, a tie and a dead note
+#   3. 3/4, triplet eighths and a half note
+#
+# The chord, the mix table, the text, the tie, the dead note and the bend
+# are left out by the importer with warnings. In version 5 every measure
+# has a second voice, which is left out as well.
+#
+# These files are written from the file format, not saved by Guitar Pro
+# itself, so they only show that the importer reads what the format
+# describes.
+#
+#   python3 gen_guitarpro.py
+
+import os
+import struct
+
+VERSIONS = [(3, 0), (4, 6), (5, 0), (5, 10)]
+
+# measure header flags
+NUMERATOR = 0x01
+DENOMINATOR = 0x02
+REPEAT_START = 0x04
+REPEAT_END = 0x08
+ALTERNATE_ENDING = 0x10
+MARKER = 0x20
+KEY_SIGNATURE = 0x40
+
+# beat flags
+DOTTED = 0x01
+CHORD_DIAGRAM = 0x02
+TEXT = 0x04
+MIX_TABLE = 0x10
+TUPLET = 0x20
+
+# note flags
+NOTE_EFFECTS = 0x08
+NOTE_KIND = 0x20
+
+# note kinds
+NORMAL = 1
+TIE = 2
+DEAD = 3
+
+# durations
+HALF = -1
+QUARTER = 0
+EIGHTH = 1
+WHOLE = -2
+
+
+class Writer:
+    """Writes the little endian values of a Guitar Pro file."""
+
+    def __init__(self, major, minor):
+        self.data = bytearray()
+        self.major = major
+        self.minor = minor
+        self.gp5 = major == 5
+        self.gp51 = major == 5 and minor > 0
+
+    def byte(self, value):
+        self.data += struct.pack('<B', value & 0xff)
+
+    def signed_byte(self, value):
+        self.data += struct.pack('<b', value)
+
+    def int(self, value):
+        self.data += struct.pack('<i', value)
+
+    def padding(self, size):
+        self.data += bytes(size)
+
+    def byte_size_string(self, text, size):
+        """A string of at most size bytes, after its length as a byte."""
+        encoded = text.encode('latin1')
+        self.byte(len(encoded))
+        self.data += encoded + bytes(size - len(encoded))
+
+    def int_byte_size_string(self, text):
+        """A string after its length plus one as an int, and as a byte."""
+        encoded = text.encode('latin1')
+        self.int(len(encoded) + 1)
+        self.byte(len(encoded))
+        self.data += encoded
+
+    def int_size_string(self, text):
+        """A string after its length as an int."""
+        encoded = text.encode('latin1')
+        self.int(len(encoded))
+        self.data += encoded
+
+
+class Note:
+    def __init__(self, string, fret, kind=NORMAL, bend=False):
+        self.string = string
+        self.fret = fret
+        self.kind = kind
+        self.bend = bend
+
+
+class Beat:
+    def __init__(self, duration, notes, dotted=False, tuplet=None,
+                 chord=False, mix=False, text=None):
+        self.duration = duration
+        self.notes = notes
+        self.dotted = dotted
+        self.tuplet = tuplet
+        self.chord = chord
+        self.mix = mix
+        self.text = text
+
+
+def write_info(w):
+    w.byte_size_string("FICHIER GUITAR PRO v%d.%02d" % (w.major, w.minor), 30)
+
+    # title, subtitle, artist, album, words, music in version 5, copyright,
+    # tab and instructions
+    w.int_byte_size_string("Test Song")
+    for _ in range(8 if w.gp5 else 7):
+        w.int_byte_size_string("x")
+
+    # one line of notice
+    w.int(1)
+    w.int_byte_size_string("notice")
+
+    if w.major < 5:
+        # triplet feel
+        w.byte(0)
+
+    if w.major >= 4:
+        # lyrics of track 1, in five lines each starting at a measure
+        w.int(1)
+        for line in range(5):
+            w.int(1)
+            w.int_size_string("la la" if line == 0 else "")
+
+    if w.gp5:
+        if w.gp51:
+            # master effect
+            w.padding(19)
+        # page setup, then its header and footer lines
+        w.padding(30)
+        for _ in range(11):
+            w.int_byte_size_string("p")
+
+    w.int(120)  # tempo
+    if w.major == 3:
+        w.int(0)  # key
+    elif w.major == 4:
+        w.int(0)  # key
+        w.signed_byte(0)  # octave
+    else:
+        if w.gp51:
+            w.byte(0)  # hide tempo
+        w.signed_byte(0)  # key
+        w.int(0)  # octave
+
+    # 4 ports of 16 MIDI channels
+    w.padding(64 * 12)
+
+    if w.gp5:
+        # directions and the master reverb
+        w.padding(38)
+        w.int(0)
+
+
+def write_measure_header(w, index, flags, numerator=None, denominator=None, marker=None):
+    if w.gp5 and index > 0:
+        w.byte(0)
+    w.byte(flags)
+
+    if flags & NUMERATOR:
+        w.signed_byte(numerator)
+    if flags & DENOMINATOR:
+        w.signed_byte(denominator)
+    if flags & REPEAT_END:
+        w.signed_byte(2)
+    if w.major < 5 and flags & ALTERNATE_ENDING:
+        w.byte(1)
+    if flags & MARKER:
+        w.int_byte_size_string(marker)
+        w.padding(4)  # color
+    if w.gp5 and flags & ALTERNATE_ENDING:
+        w.byte(1)
+    if flags & KEY_SIGNATURE:
+        w.signed_byte(0)
+        w.signed_byte(0)
+
+    if w.gp5:
+        if flags & (NUMERATOR | DENOMINATOR):
+            w.padding(4)  # beams
+        if not flags & ALTERNATE_ENDING:
+            w.byte(0)
+        w.byte(0)  # triplet feel
+
+
+def write_track(w, index, name, tuning, capo):
+    w.byte(0)  # not a percussion track
+    if w.gp5 and (index == 0 or not w.gp51):
+        w.byte(0)
+
+    w.byte_size_string(name, 40)
+    w.int(len(tuning))
+    for string in range(7):
+        w.int(tuning[string] if string < len(tuning) else 0)
+
+    w.int(1)  # port
+    w.int(1)  # channel
+    w.int(2)  # effects channel
+    w.int(24)  # frets
+    w.int(capo)
+    w.padding(4)  # color
+
+    if w.gp51:
+        w.padding(49)
+        w.int_byte_size_string("a")
+        w.int_byte_size_string("b")
+    elif w.gp5:
+        w.padding(44)
+
+
+def write_bend(w):
+    if w.major == 3:
+        w.byte(1)  # effect flags
+    else:
+        w.byte(1)  # effect flags
+        w.byte(0)  # more effect flags
+
+    w.byte(1)  # type
+    w.int(50)  # value
+    w.int(2)  # points
+    w.padding(18)
+
+
+def write_note(w, note):
+    flags = NOTE_KIND
+    if note.bend:
+        flags |= NOTE_EFFECTS
+    w.byte(flags)
+    w.byte(note.kind)
+    w.signed_byte(note.fret)
+    if w.gp5:
+        w.byte(0)
+    if note.bend:
+        write_bend(w)
+
+
+def write_chord_diagram(w):
+    if w.gp5:
+        w.padding(107)
+    elif w.major == 4:
+        w.byte(1)  # new format
+        w.padding(106)
+    else:
+        w.byte(1)  # new format
+        w.padding(25 + 35 + 4 + 24 + 36)
+
+
+def write_mix_table(w):
+    w.signed_byte(0)  # instrument
+    if w.gp5:
+        w.padding(16)  # RSE instrument
+
+    # volume, balance, chorus, reverb, phaser and tremolo stay the same
+    for _ in range(6):
+        w.signed_byte(-1)
+
+    if w.gp5:
+        w.int_byte_size_string("")  # tempo name
+    w.int(140)  # tempo
+    w.signed_byte(0)  # tempo duration
+    if w.gp51:
+        w.byte(0)  # hide tempo
+    if w.major >= 4:
+        w.byte(0)  # changes apply to all tracks
+    if w.gp5:
+        w.byte(0)  # wah
+    if w.gp51:
+        w.int_byte_size_string("")  # RSE effect
+        w.int_byte_size_string("")  # RSE effect category
+
+
+def write_beat(w, beat):
+    flags = 0
+    if beat.dotted:
+        flags |= DOTTED
+    if beat.chord:
+        flags |= CHORD_DIAGRAM
+    if beat.text:
+        flags |= TEXT
+    if beat.mix:
+        flags |= MIX_TABLE
+    if beat.tuplet:
+        flags |= TUPLET
+
+    w.byte(flags)
+    w.signed_byte(beat.duration)
+    if beat.tuplet:
+        w.int(beat.tuplet)
+    if beat.chord:
+        write_chord_diagram(w)
+    if beat.text:
+        w.int_byte_size_string(beat.text)
+    if beat.mix:
+        write_mix_table(w)
+
+    # the strings with a note, the first string in bit 6
+    strings = 0
+    for note in beat.notes:
+        strings |= 0x40 >> note.string
+    w.byte(strings)
+    for note in sorted(beat.notes, key=lambda note: note.string):
+        write_note(w, note)
+
+    if w.gp5:
+        w.padding(2)  # more beat flags
+
+
+def write_measure(w, beats):
+    w.int(len(beats))
+    for beat in beats:
+        write_beat(w, beat)
+
+    if w.gp5:
+        # a second voice
+        w.int(1)
+        write_beat(w, Beat(QUARTER, [Note(0, 7)]))
+        w.byte(0)  # line break
+
+
+def song(major, minor):
+    w = Writer(major, minor)
+    write_info(w)
+
+    w.int(3)  # measures
+    w.int(2)  # tracks
+
+    write_measure_header(w, 0, NUMERATOR | DENOMINATOR, numerator=4, denominator=4)
+    write_measure_header(w, 1, MARKER | REPEAT_START, marker="Chorus")
+    write_measure_header(w, 2, NUMERATOR, numerator=3)
+
+    write_track(w, 0, "Guitar", [64, 59, 55, 50, 45, 40], 2)
+    write_track(w, 1, "Bass", [43, 38, 33, 28], 0)
+    if w.gp5:
+        w.padding(1 if w.gp51 else 2)
+
+    # the measures of both tracks, one after the other
+    write_measure(w, [
+        Beat(QUARTER, [Note(0, 0), Note(5, 3)]),
+        Beat(QUARTER, [Note(1, 1)]),
+        Beat(QUARTER, [Note(2, 12)], chord=True),
+        Beat(QUARTER, []),
+    ])
+    write_measure(w, [Beat(WHOLE, [Note(3, 5)])])
+
+    write_measure(w, [
+        Beat(EIGHTH, [Note(0, 2)]),
+        Beat(EIGHTH, [Note(0, 3, bend=True)], mix=True),
+        Beat(QUARTER, [Note(0, 3, kind=TIE)], text="hi"),
+        Beat(QUARTER, [Note(1, 5, kind=DEAD)]),
+        Beat(EIGHTH, [Note(4, 10)]),
+    ])
+    write_measure(w, [Beat(WHOLE, [Note(3, 5)])])
+
+    write_measure(w, [
+        Beat(EIGHTH, [Note(0, 1)], tuplet=3),
+        Beat(EIGHTH, [Note(0, 2)], tuplet=3),
+        Beat(EIGHTH, [Note(0, 3)], tuplet=3),
+        Beat(HALF, [Note(1, 4)]),
+    ])
+    write_measure(w, [])
+
+    return bytes(w.data)
+
+
+if __name__ == '__main__':
+    here = os.path.dirname(os.path.abspath(__file__))
+    for major, minor in VERSIONS:
+        name = 'v%d%02d.gp%d' % (major, minor, major)
+        with open(os.path.join(here, name), 'wb') as f:
+            f.write(song(major, minor))
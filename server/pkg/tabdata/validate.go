@@ -0,0 +1,304 @@
+package tabdata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits on what the editor can show. Frets are counted from the capo, so
+// with a capo on the 5th fret the highest fret is MaxFret+5.
+const (
+	MaxCapo    = 24
+	MaxFret    = 24
+	MaxStrings = 16
+	MaxBeats   = 128
+)
+
+// maxReported is how many problems are listed before the rest is counted.
+const maxReported = 20
+
+// Error is a problem with a single value in the JSON of a tab. Path points
+// at it like a JSONPath, $.sections[0].measures[2].beats for example.
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// Errors are all problems found in a tab.
+type Errors []Error
+
+func (e Errors) Error() string {
+	var lines []string
+	for i, err := range e {
+		if i == maxReported {
+			lines = append(lines, fmt.Sprintf("and %d more", len(e)-maxReported))
+			break
+		}
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Parse decodes the JSON of a tab and validates it. Problems are returned
+// as Errors.
+func Parse(contents []byte) (*TabData, error) {
+	res, err := Decode(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Decode decodes the JSON of a tab without validating it, for tabs which
+// were stored before validation existed.
+func Decode(contents []byte) (*TabData, error) {
+	var res TabData
+	err := json.Unmarshal(contents, &res)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &syntaxErr):
+		return nil, Errors{{pathAt(contents, syntaxErr.Offset), syntaxErr.Error()}}
+	case errors.As(err, &typeErr):
+		msg := fmt.Sprintf("expected %s, got %s", typeName(typeErr.Type.String()), typeErr.Value)
+		return nil, Errors{{pathAt(contents, typeErr.Offset), msg}}
+	default:
+		return nil, Errors{{"$", err.Error()}}
+	}
+	return &res, nil
+}
+
+func typeName(goType string) string {
+	switch strings.TrimLeft(goType, "*") {
+	case "int":
+		return "an integer"
+	case "string":
+		return "a string"
+	case "tabdata.Config", "tabdata.TabData", "tabdata.SectionData", "tabdata.MeasureData", "tabdata.StringData", "tabdata.NoteData":
+		return "an object"
+	}
+	if strings.HasPrefix(goType, "[]") {
+		return "an array"
+	}
+	return goType
+}
+
+type validator struct {
+	errs Errors
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, Error{path, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks that the editor can load the tab: every measure has a
+// string for every string of its section, every string as many notes as the
+// measure has beats, and frets are within range.
+func (t *TabData) Validate() error {
+	var v validator
+
+	capo := t.CapoFret()
+	if t.Capo == nil {
+		v.add("$.capo", "missing")
+	} else if capo < 0 || capo > MaxCapo {
+		v.add("$.capo", "must be between 0 and %d", MaxCapo)
+		capo = 0
+	}
+
+	if t.Config == nil {
+		v.add("$.config", "missing")
+	} else {
+		t.Config.validate(&v, "$.config")
+	}
+
+	if t.Sections == nil {
+		v.add("$.sections", "missing")
+	}
+	for i := range t.Sections {
+		t.Sections[i].validate(&v, fmt.Sprintf("$.sections[%d]", i), capo)
+	}
+
+	return v.err()
+}
+
+func (c *Config) validate(v *validator, path string) {
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"startSections", c.StartSections},
+		{"startMeasures", c.StartMeasures},
+		{"startNotesPerMeasure", c.StartNotesPerMeasure},
+	} {
+		if n.value < 1 {
+			v.add(path+"."+n.name, "must be at least 1")
+		}
+	}
+	if c.StartNotesPerMeasure > MaxBeats {
+		v.add(path+".startNotesPerMeasure", "must be at most %d", MaxBeats)
+	}
+
+	validateStringNames(v, path+".stringNames", c.StringNames)
+	if c.StringNames != nil && c.StartStrings != len(c.StringNames) {
+		v.add(path+".startStrings", "is %d, but there are %d string names", c.StartStrings, len(c.StringNames))
+	}
+}
+
+func validateStringNames(v *validator, path string, names []string) {
+	switch {
+	case names == nil:
+		v.add(path, "missing")
+	case len(names) == 0:
+		v.add(path, "a tab needs at least one string")
+	case len(names) > MaxStrings:
+		v.add(path, "has %d strings, at most %d are allowed", len(names), MaxStrings)
+	}
+}
+
+func (s *SectionData) validate(v *validator, path string, capo int) {
+	validateStringNames(v, path+".stringNames", s.StringNames)
+
+	if s.Measures == nil {
+		v.add(path+".measures", "missing")
+	}
+	for i, m := range s.Measures {
+		mPath := fmt.Sprintf("%s.measures[%d]", path, i)
+
+		beatsOk := true
+		if m.Beats < 1 || m.Beats > MaxBeats {
+			v.add(mPath+".beats", "must be between 1 and %d", MaxBeats)
+			beatsOk = false
+		}
+
+		if m.Strings == nil {
+			v.add(mPath+".strings", "missing")
+		} else if s.StringNames != nil && len(m.Strings) != len(s.StringNames) {
+			v.add(mPath+".strings", "has %d strings, but the section has %d", len(m.Strings), len(s.StringNames))
+		}
+
+		for j, str := range m.Strings {
+			sPath := fmt.Sprintf("%s.strings[%d].notes", mPath, j)
+			if str.Notes == nil {
+				v.add(sPath, "missing")
+				continue
+			}
+			if beatsOk && len(str.Notes) != m.Beats {
+				v.add(sPath, "has %d notes, but the measure has %d beats", len(str.Notes), m.Beats)
+			}
+
+			for k, note := range str.Notes {
+				fret := note.FretNumber
+				if fret != nil && (*fret < 0 || *fret > capo+MaxFret) {
+					v.add(fmt.Sprintf("%s[%d].fretNumber", sPath, k), "fret %d is not between 0 and %d", *fret, capo+MaxFret)
+				}
+			}
+		}
+	}
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type pathElement struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+func formatPath(stack []pathElement) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, e := range stack {
+		switch {
+		case e.array:
+			fmt.Fprintf(&b, "[%d]", e.index)
+		case identifier.MatchString(e.key):
+			b.WriteString("." + e.key)
+		default:
+			fmt.Fprintf(&b, "[%q]", e.key)
+		}
+	}
+	return b.String()
+}
+
+// pathAt finds the path of the value in data which ends at offset, which is
+// where encoding/json reports errors. It falls back to the last value before
+// offset.
+func pathAt(data []byte, offset int64) string {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []pathElement
+	last := "$"
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return last
+		}
+		end := dec.InputOffset()
+
+		// a key in an object
+		if n := len(stack); n > 0 && !stack[n-1].array && stack[n-1].expectKey {
+			if key, ok := tok.(string); ok {
+				stack[n-1].key = key
+				stack[n-1].expectKey = false
+				continue
+			}
+		}
+
+		var path string
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			path = formatPath(stack)
+			stack = append(stack, pathElement{array: tok == json.Delim('['), expectKey: tok == json.Delim('{')})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			path = formatPath(stack)
+			next(stack)
+		default:
+			path = formatPath(stack)
+			next(stack)
+		}
+
+		if end >= offset {
+			if end == offset {
+				return path
+			}
+			return last
+		}
+		last = path
+	}
+}
+
+// next moves past a finished value to the next element or key.
+func next(stack []pathElement) {
+	n := len(stack)
+	if n == 0 {
+		return
+	}
+	if stack[n-1].array {
+		stack[n-1].index += 1
+	} else {
+		stack[n-1].expectKey = true
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// backup writes a full or incremental backup to a file. With -server it is
+// fetched from a running server, otherwise the store is opened directly,
+// which only works while no server is using it.
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", "", "file to write the backup to")
+	since := flags.Uint64("since", 0, "only back up changes after this version, from a previous backup")
+	url := flags.String("server", "", "url of a running server to back up")
+	token := flags.String("token", os.Getenv("TOKEN"), "admin token for -server, defaults to $TOKEN")
+	_ = flags.Parse(args)
+
+	if *out == "" {
+		return errors.New("no output file given (-o)")
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var version uint64
+	if *url != "" {
+		version, err = remoteBackup(f, *url, *token, *since)
+	} else {
+		version, err = localBackup(f, *since)
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+
+	log.Printf("wrote backup to %s, continue with -since %d", *out, version)
+	return nil
+}
+
+func localBackup(w io.Writer, since uint64) (uint64, error) {
+	store, err := server.OpenStore()
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	return store.Backup(w, since)
+}
+
+func remoteBackup(w io.Writer, url string, token string, since uint64) (uint64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Token": token,
+		"Since": since,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.Post(strings.TrimSuffix(url, "/")+"/admin/backup", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("server responded with %s: %s", resp.Status, msg)
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return 0, err
+	}
+
+	// trailers are only available after reading the whole body
+	version := resp.Trailer.Get("Backup-Version")
+	if version == "" {
+		return 0, errors.New("backup is incomplete, check the server logs")
+	}
+	return strconv.ParseUint(version, 10, 64)
+}
+
+// restore loads backups into a fresh badger directory and verifies the result.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := flags.String("to", "", "empty directory to restore into")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: ainulindale restore -to DIR FULL_BACKUP [INCREMENTAL_BACKUP...]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *to == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	stats, err := server.RestoreBackup(*to, flags.Args()...)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restored %s into %s", stats, *to)
+	return nil
+}
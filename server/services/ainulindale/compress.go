@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+)
+
+// compress compresses all records stored before compression existed, which
+// the server otherwise does in the background when it starts.
+func compress() error {
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n, err := store.Recompress()
+	if err != nil {
+		return err
+	}
+
+	stats, err := store.CompressionStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("compressed %d records\n%s\n", n, stats)
+	return nil
+}
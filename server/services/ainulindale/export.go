@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+	"log"
+	"os"
+)
+
+// export writes everything in the store to a portable archive, which can be
+// imported into a store with another backend or a newer version.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", "", "file to write the export to")
+	_ = flags.Parse(args)
+
+	if *out == "" {
+		return errors.New("no output file given (-o)")
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := server.OpenStore()
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+	defer store.Close()
+
+	manifest, err := store.Export(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+
+	log.Printf("exported %s to %s", manifest, *out)
+	return nil
+}
+
+// importExport reads an archive written by export into the store.
+func importExport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	mode := flags.String("mode", server.ImportMerge, "merge: add to the store, replace: delete everything in the store first")
+	onCollision := flags.String("on-collision", server.CollisionRename, "what to do with imported users whose name is taken when merging: rename or skip")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: ainulindale import [-mode merge|replace] [-on-collision rename|skip] FILE\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Import(f, server.ImportOptions{
+		Mode:        *mode,
+		OnCollision: *onCollision,
+	})
+	if report != nil {
+		fmt.Println(report)
+	}
+	return err
+}
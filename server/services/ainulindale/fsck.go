@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+	"os"
+)
+
+// fsck checks the store for inconsistencies between users and tabs.
+// It exits with status 1 when problems were found and not repaired.
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems that were found")
+	_ = flags.Parse(args)
+
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(report)
+	if len(report.Problems) > 0 && !*repair {
+		store.Close()
+		os.Exit(1)
+	}
+	return nil
+}
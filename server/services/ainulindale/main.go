@@ -1,12 +1,69 @@
 package main
 
 import (
+	"fmt"
 	"github.com/jonay2000/ainulindale/server/pkg/server"
 	"log"
+	"os"
 )
 
+const usage = `usage: ainulindale [command] [flags]
+
+commands:
+  serve                 run the server (default)
+  migrate [-dry-run]    upgrade all records to the current schema
+  reindex               rebuild the secondary indexes
+  compress              compress records stored before compression existed
+  fsck [-repair]        check that users and tabs agree
+  backup -o FILE        write a backup, see backup -h
+  restore -to DIR FILE  restore backups into a new directory
+  export -o FILE        write a portable archive of all users and tabs
+  import FILE           read an export, see import -h for merging
+  rotate-key            re-encrypt the store with a new data key, and with
+                        -new-key-file FILE protect it with a new master key
+
+The store is opened at $DB_LOCATION. It is encrypted with the master key in
+the file $ENCRYPTION_KEY_FILE, or in $ENCRYPTION_KEY: 32 bytes, optionally hex
+or base64 encoded. Without a key an encrypted store can't be opened.
+`
+
 func main() {
-	if err := server.StartServer(); err != nil {
+	cmd := "serve"
+	var args []string
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+		args = os.Args[2:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = server.StartServer()
+	case "migrate":
+		err = migrate(args)
+	case "reindex":
+		err = reindex()
+	case "compress":
+		err = compress()
+	case "fsck":
+		err = fsck(args)
+	case "backup":
+		err = backup(args)
+	case "restore":
+		err = restore(args)
+	case "export":
+		err = export(args)
+	case "import":
+		err = importExport(args)
+	case "rotate-key":
+		err = rotateKey(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		log.Fatalf("unknown command %s\n%s", cmd, usage)
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+)
+
+// migrate upgrades all records in the store to the current schema.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be upgraded")
+	_ = flags.Parse(args)
+
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(report)
+	if !*dryRun {
+		return nil
+	}
+	for _, key := range report.Upgraded {
+		fmt.Printf("  %s\n", key)
+	}
+	return nil
+}
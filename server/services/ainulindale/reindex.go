@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+)
+
+// reindex regenerates all secondary indexes from the stored tabs.
+func reindex() error {
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n, err := store.RebuildIndexes()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("indexed %d tabs\n", n)
+	return nil
+}
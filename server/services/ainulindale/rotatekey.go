@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jonay2000/ainulindale/server/pkg/server"
+	"os"
+)
+
+// rotateKey re-encrypts everything in the store with a new data key.
+//
+// The store is opened with the current master key from ENCRYPTION_KEY_FILE
+// or ENCRYPTION_KEY. With -new-key-file the new data key is protected with
+// the key in that file, which has to be used to open the store from then on.
+// A key is 32 random bytes, optionally hex or base64 encoded, for example
+// from `head -c 32 /dev/urandom > key`.
+//
+// To encrypt an existing store, start it once with a key configured, after
+// which new writes are encrypted, and run rotate-key to encrypt the rest.
+// Like the other commands it only works while no server is using the store.
+func rotateKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "file with the new master key, keeps the current one if empty")
+	_ = flags.Parse(args)
+
+	var newKey []byte
+	if *newKeyFile != "" {
+		b, err := os.ReadFile(*newKeyFile)
+		if err != nil {
+			return err
+		}
+		newKey, err = server.ParseEncryptionKey(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n, err := store.RotateKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("re-encrypted %d values\n", n)
+	if *newKeyFile != "" {
+		fmt.Printf("the store can now only be opened with the key in %s\n", *newKeyFile)
+	}
+	return nil
+}